@@ -0,0 +1,200 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "flag"
+        "fmt"
+        "io"
+        "os"
+        "sort"
+        "strings"
+
+        "maunium.net/go/mautrix"
+
+        "github.com/ricardo-duarte-av/matrix-health/monitor"
+)
+
+// Command line: global flags and the check and rooms commands
+// ==============================================================
+
+// Global flags, accepted before or after the command. The configuration path can also be set
+// with MATRIX_HEALTH_CONFIG.
+var cli = struct {
+        ConfigPath string
+        Format     string
+}{
+        ConfigPath: configPathFromEnvironment(),
+        Format:     "text",
+}
+
+func configPathFromEnvironment() string {
+        if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+                return path
+        }
+        return "config.yaml"
+}
+
+func addGlobalFlags(flags *flag.FlagSet) {
+        flags.StringVar(&cli.ConfigPath, "config", cli.ConfigPath, "path of the configuration file")
+        flags.StringVar(&cli.Format, "format", cli.Format, "output format of check and rooms: text or json")
+}
+
+func usage() {
+        fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command] [arguments]
+
+Commands:
+  serve               run the bot and the dashboard (default)
+  check <servername>  resolve and check a single server, and print a detailed report
+  rooms               sync once, check every server and list the rooms with their servers
+  nagios              run one check cycle as a Nagios/Icinga plugin; see nagios -h
+
+Flags:
+`, os.Args[0])
+        flag.PrintDefaults()
+}
+
+// parseCommandFlags parses the flags after a command and exits if they, or the number of
+// remaining arguments, are wrong
+func parseCommandFlags(command string, args []string, nargs int) []string {
+        flags := flag.NewFlagSet(command, flag.ExitOnError)
+        flags.Usage = usage
+        addGlobalFlags(flags)
+        flags.Parse(args)
+        if cli.Format != "text" && cli.Format != "json" {
+                fmt.Fprintf(os.Stderr, "Unknown format %q, expected text or json\n", cli.Format)
+                os.Exit(2)
+        }
+        if flags.NArg() != nargs {
+                usage()
+                os.Exit(2)
+        }
+        return flags.Args()
+}
+
+// logOutput receives the progress and error messages of the monitor and of the setup shared with the
+// one-shot commands, which send them to stderr so that stdout carries nothing but the report
+var logOutput io.Writer = os.Stdout
+
+// writeReport prints text or value as JSON, depending on the format flag
+func writeReport(out io.Writer, text string, value interface{}) {
+        if cli.Format == "json" {
+                encoder := json.NewEncoder(out)
+                encoder.SetIndent("", "  ")
+                encoder.Encode(value)
+                return
+        }
+        fmt.Fprintln(out, text)
+}
+
+// checkCommand checks a single server without logging in. The configuration file is optional;
+// only its advisories and probe timeout are used. The exit code is 0 when the server is OK and its signing
+// keys verify, and 1 otherwise.
+func checkCommand(ctx context.Context, args []string) int {
+        args = parseCommandFlags("check", args, 1)
+        logOutput = os.Stderr
+
+        server, err := monitor.ParseServerName(args[0])
+        if err != nil {
+                fmt.Fprintln(logOutput, "Invalid server name:", err)
+                return 2
+        }
+
+        if err := loadConfig(cli.ConfigPath, false); err != nil {
+                fmt.Fprintf(logOutput, "Invalid configuration in %s:\n%v\n", cli.ConfigPath, err)
+                return 1
+        }
+        opts := config.monitorOptions()
+        if config.Advisories != "" {
+                if opts.Advisories, err = monitor.LoadAdvisories(config.Advisories); err != nil {
+                        fmt.Fprintln(logOutput, "Failed to load advisories:", err)
+                        return 1
+                }
+        }
+
+        mon, err := monitor.New(opts)
+        if err != nil {
+                fmt.Fprintln(logOutput, "Failed to create monitor:", err)
+                return 1
+        }
+        report := mon.InspectServer(ctx, server)
+        writeReport(os.Stdout, report.Format(), report)
+        // A server that answers but whose signing keys do not verify cannot federate either
+        if report.Check.Status != "OK" || (report.Check.Keys != nil && !report.Check.Keys.OK()) {
+                return 1
+        }
+        return 0
+}
+
+// logout removes the temporary device of a one-shot command
+func logout(client *mautrix.Client) {
+        if _, err := client.Logout(context.Background()); err != nil {
+                fmt.Fprintln(logOutput, "Failed to log out:", err)
+        }
+}
+
+// roomsCommand logs in, with a temporary device unless an access token is configured, syncs once, checks every server and lists the rooms
+// with their servers and statuses. Nothing is posted to the log room and the history is left alone.
+func roomsCommand(ctx context.Context, args []string) int {
+        parseCommandFlags("rooms", args, 0)
+        logOutput = os.Stderr
+
+        if err := loadConfig(cli.ConfigPath, true); err != nil {
+                fmt.Fprintf(logOutput, "Invalid configuration in %s:\n%v\n", cli.ConfigPath, err)
+                return 1
+        }
+        client, newDevice, err := login(ctx)
+        if err != nil {
+                fmt.Fprintln(logOutput, err)
+                return 1
+        }
+        if newDevice {
+                defer logout(client)
+        }
+
+        opts := config.monitorOptions()
+        opts.Client = monitor.NewMatrixClient(client)
+        opts.Silent = true
+        mon, err := monitor.New(opts)
+        if err != nil {
+                fmt.Fprintln(logOutput, "Failed to create monitor:", err)
+                return 1
+        }
+        if err := mon.RunOnce(ctx); err != nil {
+                fmt.Fprintln(logOutput, "Check cycle did not complete:", err)
+                return 1
+        }
+
+        rooms := mon.Rooms()
+        writeReport(os.Stdout, formatRooms(rooms), rooms)
+        return 0
+}
+
+// formatRooms lists the rooms by name, each with its servers by number of users
+func formatRooms(rooms map[string]*monitor.TreeNode) string {
+        roomIDs := make([]string, 0, len(rooms))
+        for roomID := range rooms {
+                roomIDs = append(roomIDs, roomID)
+        }
+        sort.Slice(roomIDs, func(i, j int) bool {
+                return rooms[roomIDs[i]].Name < rooms[roomIDs[j]].Name
+        })
+
+        var sb strings.Builder
+        for _, roomID := range roomIDs {
+                room := rooms[roomID]
+                fmt.Fprintf(&sb, "%s (%s)\n", room.Name, roomID)
+
+                servers := append([]*monitor.TreeNode(nil), room.Children...)
+                sort.SliceStable(servers, func(i, j int) bool {
+                        return servers[i].UserCount > servers[j].UserCount
+                })
+                for _, server := range servers {
+                        fmt.Fprintf(&sb, "  %-30s %5d users  %s\n", server.Name, server.UserCount, server.Status)
+                }
+        }
+        if sb.Len() == 0 {
+                return "No rooms."
+        }
+        return strings.TrimSuffix(sb.String(), "\n")
+}
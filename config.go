@@ -0,0 +1,280 @@
+package main
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "io"
+        "io/fs"
+        "net"
+        "net/url"
+        "os"
+        "reflect"
+        "strconv"
+        "strings"
+        "time"
+
+        "gopkg.in/yaml.v3"
+        "maunium.net/go/mautrix/id"
+
+        "github.com/ricardo-duarte-av/matrix-health/monitor"
+)
+
+// Configuration: YAML file, environment overrides, secrets files, defaults and validation
+// ==============================================================
+
+const (
+        defaultDatabasePath = "matrix-health.db"
+        defaultListen       = "0.0.0.0:6000"
+
+        // Every setting can be overridden by an environment variable named after its YAML key,
+        // e.g. MATRIX_HEALTH_PASSWORD or MATRIX_HEALTH_PROBE_CONCURRENCY
+        envPrefix = "MATRIX_HEALTH_"
+
+        minInterval = 10 // seconds
+)
+
+// Config represents the structure of the YAML configuration file
+type Config struct {
+        ServerName string `yaml:"servername"` // Homeserver URL of the bot account, e.g. https://matrix.org
+        Username   string `yaml:"username"`
+        LogRoom    string `yaml:"logroom"`
+        Interval   int    `yaml:"interval"` // Interval in seconds
+
+        // Credentials: a password or an access token, each given directly or read from a file.
+        // An access token reuses an existing device instead of logging in with a new one.
+        Password        string `yaml:"password"`
+        PasswordFile    string `yaml:"password_file"`
+        AccessToken     string `yaml:"access_token"`
+        AccessTokenFile string `yaml:"access_token_file"`
+
+        // Address the dashboard, JSON API and metrics are served on
+        Listen string `yaml:"listen"`
+
+        // Path of the check history database
+        Database string `yaml:"database"`
+
+        // Concurrency limits and the time allowed for each probe request
+        APIConcurrency   int `yaml:"api_concurrency"`   // Concurrent client API calls to our homeserver
+        ProbeConcurrency int `yaml:"probe_concurrency"` // Concurrent federation probes
+        ProbeTimeout     int `yaml:"probe_timeout"`     // Seconds
+
+        // YAML file of known problems of homeserver versions, see sample.advisories.yaml. Servers that match
+        // are flagged in the tree; with report_advisories the log room is told as well.
+        Advisories       string `yaml:"advisories"`
+        ReportAdvisories bool   `yaml:"report_advisories"`
+
+        // Flap damping: failed checks in a row before a server is marked down, OK checks in a row before it is
+        // marked up again, and retries of transient failures within a cycle (0 disables them), the first one
+        // after retry_backoff seconds and each further one after twice as long.
+        FailureThreshold  int `yaml:"failure_threshold"`
+        RecoveryThreshold int `yaml:"recovery_threshold"`
+        ProbeRetries      int `yaml:"probe_retries"`
+        RetryBackoff      int `yaml:"retry_backoff"`
+
+        // Days before a certificate expires that the log room is warned
+        CertWarningDays int `yaml:"cert_warning_days"`
+
+        // Seconds a room the bot left, or a server without members, stays in the tree marked as departed.
+        // Zero removes them right away.
+        DepartedGrace int `yaml:"departed_grace"`
+
+        // Shutdown behaviour on SIGINT/SIGTERM
+        ShutdownTimeout  int  `yaml:"shutdown_timeout"`   // Seconds allowed for a graceful shutdown
+        LogoutOnShutdown bool `yaml:"logout_on_shutdown"` // Log out the device created at startup
+}
+
+var config Config
+
+// defaultConfig holds the value of every optional setting that is left out
+func defaultConfig() Config {
+        return Config{
+                Interval:          int(monitor.DefaultInterval / time.Second),
+                Listen:            defaultListen,
+                Database:          defaultDatabasePath,
+                APIConcurrency:    monitor.DefaultAPIConcurrency,
+                ProbeConcurrency:  monitor.DefaultProbeConcurrency,
+                ProbeTimeout:      int(monitor.DefaultProbeTimeout / time.Second),
+                FailureThreshold:  monitor.DefaultFailureThreshold,
+                RecoveryThreshold: monitor.DefaultRecoveryThreshold,
+                ProbeRetries:      monitor.DefaultProbeRetries,
+                RetryBackoff:      int(monitor.DefaultRetryBackoff / time.Second),
+                CertWarningDays:   int(monitor.DefaultCertExpiryWarning / (24 * time.Hour)),
+                DepartedGrace:     3600,
+                ShutdownTimeout:   defaultShutdownTimeout,
+        }
+}
+
+// loadConfig reads the configuration file over the defaults, applies the environment overrides and
+// the secrets files, and validates the result, reporting every problem at once. Commands that do not
+// log in pass account as false: the file may then be missing, and the account settings are not checked.
+func loadConfig(path string, account bool) error {
+        fmt.Fprintf(logOutput, "Loading configuration from: %s\n", path)
+        config = defaultConfig()
+        var problems []error
+        data, err := os.ReadFile(path)
+        switch {
+        case err == nil:
+                // Unknown keys, e.g. misspelt ones, and values of the wrong type are reported with the other
+                // problems, and the rest of the file is still read. An empty file decodes to io.EOF.
+                decoder := yaml.NewDecoder(bytes.NewReader(data))
+                decoder.KnownFields(true)
+                var typeErr *yaml.TypeError
+                if err := decoder.Decode(&config); errors.As(err, &typeErr) {
+                        for _, e := range typeErr.Errors {
+                                problems = append(problems, errors.New(e))
+                        }
+                } else if err != nil && err != io.EOF {
+                        return err
+                }
+        case !account && errors.Is(err, fs.ErrNotExist):
+                fmt.Fprintln(logOutput, "No configuration file, using the defaults")
+        default:
+                return err
+        }
+
+        problems = append(problems, applyEnvironment(&config)...)
+        problems = append(problems, config.readSecrets()...)
+        problems = append(problems, config.validate(account)...)
+        return errors.Join(problems...)
+}
+
+// applyEnvironment overrides the settings that have an environment variable
+func applyEnvironment(c *Config) []error {
+        var problems []error
+        value := reflect.ValueOf(c).Elem()
+        for i := 0; i < value.NumField(); i++ {
+                key := value.Type().Field(i).Tag.Get("yaml")
+                name := envPrefix + strings.ToUpper(key)
+                env, ok := os.LookupEnv(name)
+                if !ok {
+                        continue
+                }
+
+                field := value.Field(i)
+                switch field.Kind() {
+                case reflect.String:
+                        field.SetString(env)
+                case reflect.Int:
+                        n, err := strconv.Atoi(env)
+                        if err != nil {
+                                problems = append(problems, fmt.Errorf("%s: %q is not a whole number", name, env))
+                                continue
+                        }
+                        field.SetInt(int64(n))
+                case reflect.Bool:
+                        b, err := strconv.ParseBool(env)
+                        if err != nil {
+                                problems = append(problems, fmt.Errorf("%s: %q is not true or false", name, env))
+                                continue
+                        }
+                        field.SetBool(b)
+                }
+        }
+        return problems
+}
+
+// readSecrets reads the password and access token from their files, if they are given as files
+func (c *Config) readSecrets() []error {
+        var problems []error
+        read := func(setting, path string, secret *string, direct string) {
+                if path == "" {
+                        return
+                }
+                if direct != "" {
+                        problems = append(problems, fmt.Errorf("%s and %s are both set", strings.TrimSuffix(setting, "_file"), setting))
+                        return
+                }
+                data, err := os.ReadFile(path)
+                if err != nil {
+                        problems = append(problems, fmt.Errorf("%s: %w", setting, err))
+                        return
+                }
+                *secret = strings.TrimSpace(string(data))
+                if *secret == "" {
+                        problems = append(problems, fmt.Errorf("%s: %s is empty", setting, path))
+                }
+        }
+        read("password_file", c.PasswordFile, &c.Password, c.Password)
+        read("access_token_file", c.AccessTokenFile, &c.AccessToken, c.AccessToken)
+        return problems
+}
+
+// validate checks every setting and returns all the problems found
+func (c *Config) validate(account bool) []error {
+        var problems []error
+        problem := func(format string, args ...interface{}) {
+                problems = append(problems, fmt.Errorf(format, args...))
+        }
+
+        if account {
+                if u, err := url.Parse(c.ServerName); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+                        problem("servername: %q is not an http(s) URL such as https://matrix.org", c.ServerName)
+                }
+                if c.Username == "" {
+                        problem("username is required")
+                } else if _, _, err := id.UserID(c.Username).ParseAndValidate(); err != nil {
+                        problem("username: %q is not a valid user ID: %v", c.Username, err)
+                }
+                switch {
+                case c.Password == "" && c.AccessToken == "":
+                        problem("a password or an access token is required: set password, password_file, access_token or access_token_file")
+                case c.Password != "" && c.AccessToken != "":
+                        problem("both a password and an access token are set; keep one of them")
+                }
+                if c.AccessToken != "" && c.LogoutOnShutdown {
+                        problem("logout_on_shutdown would invalidate the configured access token")
+                }
+        }
+
+        if c.LogRoom != "" && !strings.HasPrefix(c.LogRoom, "!") {
+                problem("logroom: %q is not a room ID such as !room_id:matrix.org", c.LogRoom)
+        }
+        if c.Interval < minInterval {
+                problem("interval: %d seconds is too short, the minimum is %d", c.Interval, minInterval)
+        }
+        if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+                problem("listen: %q is not a host:port address: %v", c.Listen, err)
+        } else if _, err := net.LookupPort("tcp", port); err != nil {
+                problem("listen: invalid port %q", port)
+        }
+        if c.Database == "" {
+                problem("database must not be empty")
+        }
+
+        atLeast := func(setting string, value, min int) {
+                if value < min {
+                        problem("%s: %d is less than %d", setting, value, min)
+                }
+        }
+        atLeast("api_concurrency", c.APIConcurrency, 1)
+        atLeast("probe_concurrency", c.ProbeConcurrency, 1)
+        atLeast("probe_timeout", c.ProbeTimeout, 1)
+        atLeast("failure_threshold", c.FailureThreshold, 1)
+        atLeast("recovery_threshold", c.RecoveryThreshold, 1)
+        atLeast("probe_retries", c.ProbeRetries, 0)
+        atLeast("retry_backoff", c.RetryBackoff, 1)
+        atLeast("cert_warning_days", c.CertWarningDays, 1)
+        atLeast("departed_grace", c.DepartedGrace, 0)
+        atLeast("shutdown_timeout", c.ShutdownTimeout, 1)
+        return problems
+}
+
+// monitorOptions converts the settings to monitor options. The client, store and advisories are up to the caller.
+func (c *Config) monitorOptions() monitor.Options {
+        return monitor.Options{
+                LogRoom:           id.RoomID(c.LogRoom),
+                Interval:          time.Duration(c.Interval) * time.Second,
+                APIConcurrency:    c.APIConcurrency,
+                ProbeConcurrency:  c.ProbeConcurrency,
+                ProbeTimeout:      time.Duration(c.ProbeTimeout) * time.Second,
+                FailureThreshold:  c.FailureThreshold,
+                RecoveryThreshold: c.RecoveryThreshold,
+                ProbeRetries:      c.ProbeRetries,
+                RetryBackoff:      time.Duration(c.RetryBackoff) * time.Second,
+                CertExpiryWarning: time.Duration(c.CertWarningDays) * 24 * time.Hour,
+                ReportAdvisories:  c.ReportAdvisories,
+                DepartedGrace:     time.Duration(c.DepartedGrace) * time.Second,
+                Logger:            logOutput,
+        }
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+        "io"
+        "os"
+        "path/filepath"
+        "reflect"
+        "strings"
+        "testing"
+
+        "github.com/ricardo-duarte-av/matrix-health/monitor"
+)
+
+// checkProblems reports the problems that were not expected, and the expected ones that are missing.
+// Each problem is expected by a part of its message.
+func checkProblems(t *testing.T, name string, problems []error, want []string) {
+        t.Helper()
+        if len(problems) != len(want) {
+                t.Errorf("%s: got %d problems %q, want %d", name, len(problems), problems, len(want))
+                return
+        }
+        for i, problem := range problems {
+                if !strings.Contains(problem.Error(), want[i]) {
+                        t.Errorf("%s: problem %q does not mention %q", name, problem, want[i])
+                }
+        }
+}
+
+func TestApplyEnvironment(t *testing.T) {
+        tests := []struct {
+                name   string
+                env    map[string]string
+                want   func(c *Config) // Changes to the defaults
+                errors []string
+        }{
+                {
+                        name: "string",
+                        env:  map[string]string{"MATRIX_HEALTH_PASSWORD": "hunter2"},
+                        want: func(c *Config) { c.Password = "hunter2" },
+                },
+                {
+                        name: "empty string",
+                        env:  map[string]string{"MATRIX_HEALTH_LISTEN": ""},
+                        want: func(c *Config) { c.Listen = "" },
+                },
+                {
+                        name: "number and flag",
+                        env:  map[string]string{"MATRIX_HEALTH_PROBE_CONCURRENCY": "8", "MATRIX_HEALTH_REPORT_ADVISORIES": "true"},
+                        want: func(c *Config) { c.ProbeConcurrency, c.ReportAdvisories = 8, true },
+                },
+                {
+                        name:   "invalid number",
+                        env:    map[string]string{"MATRIX_HEALTH_INTERVAL": "soon"},
+                        want:   func(c *Config) {},
+                        errors: []string{`MATRIX_HEALTH_INTERVAL: "soon" is not a whole number`},
+                },
+                {
+                        name:   "invalid flag",
+                        env:    map[string]string{"MATRIX_HEALTH_LOGOUT_ON_SHUTDOWN": "maybe"},
+                        want:   func(c *Config) {},
+                        errors: []string{`MATRIX_HEALTH_LOGOUT_ON_SHUTDOWN: "maybe" is not true or false`},
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        for name, value := range tt.env {
+                                t.Setenv(name, value)
+                        }
+                        got := defaultConfig()
+                        problems := applyEnvironment(&got)
+                        checkProblems(t, tt.name, problems, tt.errors)
+
+                        want := defaultConfig()
+                        tt.want(&want)
+                        if !reflect.DeepEqual(got, want) {
+                                t.Errorf("%s: configuration is %+v, want %+v", tt.name, got, want)
+                        }
+                })
+        }
+}
+
+func TestReadSecrets(t *testing.T) {
+        dir := t.TempDir()
+        for name, content := range map[string]string{"password": "hunter2\n", "token": "syt_token", "empty": " \n"} {
+                if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+                        t.Fatal(err)
+                }
+        }
+
+        tests := []struct {
+                name            string
+                config          Config
+                wantPassword    string
+                wantAccessToken string
+                errors          []string
+        }{
+                {name: "no files", config: Config{Password: "direct"}, wantPassword: "direct"},
+                {name: "password file", config: Config{PasswordFile: filepath.Join(dir, "password")}, wantPassword: "hunter2"},
+                {name: "access token file", config: Config{AccessTokenFile: filepath.Join(dir, "token")}, wantAccessToken: "syt_token"},
+                {
+                        name:         "password and password file",
+                        config:       Config{Password: "direct", PasswordFile: filepath.Join(dir, "password")},
+                        wantPassword: "direct",
+                        errors:       []string{"password and password_file are both set"},
+                },
+                {
+                        name:   "missing and empty files",
+                        config: Config{PasswordFile: filepath.Join(dir, "missing"), AccessTokenFile: filepath.Join(dir, "empty")},
+                        errors: []string{"password_file: open ", "access_token_file: " + filepath.Join(dir, "empty") + " is empty"},
+                },
+        }
+        for _, tt := range tests {
+                c := tt.config
+                checkProblems(t, tt.name, c.readSecrets(), tt.errors)
+                if c.Password != tt.wantPassword || c.AccessToken != tt.wantAccessToken {
+                        t.Errorf("%s: password %q and access token %q, want %q and %q", tt.name, c.Password, c.AccessToken, tt.wantPassword, tt.wantAccessToken)
+                }
+        }
+}
+
+func TestValidate(t *testing.T) {
+        valid := func(c *Config) {
+                c.ServerName = "https://matrix.example.org"
+                c.Username = "@bot:example.org"
+                c.Password = "hunter2"
+        }
+
+        tests := []struct {
+                name    string
+                change  func(c *Config) // Applied to the defaults
+                account bool
+                errors  []string
+        }{
+                {name: "defaults without an account", change: func(c *Config) {}},
+                {
+                        name:    "defaults with an account",
+                        change:  func(c *Config) {},
+                        account: true,
+                        errors:  []string{"servername:", "username is required", "a password or an access token is required"},
+                },
+                {name: "account", change: valid, account: true},
+                {
+                        name: "invalid account",
+                        change: func(c *Config) {
+                                valid(c)
+                                c.ServerName = "matrix.example.org"
+                                c.Username = "bot"
+                                c.AccessToken = "syt_token"
+                        },
+                        account: true,
+                        errors:  []string{`servername: "matrix.example.org" is not an http(s) URL`, `username: "bot" is not a valid user ID`, "both a password and an access token are set"},
+                },
+                {
+                        name: "logout with an access token",
+                        change: func(c *Config) {
+                                valid(c)
+                                c.Password, c.AccessToken = "", "syt_token"
+                                c.LogoutOnShutdown = true
+                        },
+                        account: true,
+                        errors:  []string{"logout_on_shutdown would invalidate the configured access token"},
+                },
+                {
+                        name: "account settings are not checked without an account",
+                        change: func(c *Config) {
+                                c.ServerName = "matrix.example.org"
+                                c.LogoutOnShutdown = true
+                        },
+                },
+                {
+                        name: "settings",
+                        change: func(c *Config) {
+                                c.LogRoom = "#room:example.org"
+                                c.Interval = 5
+                                c.Listen = "6000"
+                                c.Database = ""
+                        },
+                        errors: []string{`logroom: "#room:example.org" is not a room ID`, "interval: 5 seconds is too short", `listen: "6000" is not a host:port address`, "database must not be empty"},
+                },
+                {
+                        name:   "invalid port",
+                        change: func(c *Config) { c.Listen = "localhost:sixthousand" },
+                        errors: []string{`listen: invalid port "sixthousand"`},
+                },
+                {
+                        name: "limits",
+                        change: func(c *Config) {
+                                c.ProbeConcurrency = 0
+                                c.ProbeTimeout = 0
+                                c.ProbeRetries = -1
+                                c.DepartedGrace = 0
+                        },
+                        errors: []string{"probe_concurrency: 0 is less than 1", "probe_timeout: 0 is less than 1", "probe_retries: -1 is less than 0"},
+                },
+        }
+        for _, tt := range tests {
+                c := defaultConfig()
+                tt.change(&c)
+                checkProblems(t, tt.name, c.validate(tt.account), tt.errors)
+        }
+}
+
+func TestMonitorOptionsProbeRetries(t *testing.T) {
+        // Zero disables retries in the configuration and in the options alike
+        for _, retries := range []int{0, 1, monitor.DefaultProbeRetries} {
+                c := defaultConfig()
+                c.ProbeRetries = retries
+                if got := c.monitorOptions().ProbeRetries; got != retries {
+                        t.Errorf("probe_retries %d gave ProbeRetries %d", retries, got)
+                }
+        }
+        if got := defaultConfig().ProbeRetries; got != monitor.DefaultProbeRetries {
+                t.Errorf("probe_retries defaults to %d, want %d", got, monitor.DefaultProbeRetries)
+        }
+}
+
+func TestLoadConfig(t *testing.T) {
+        logOutput = io.Discard
+        t.Cleanup(func() { logOutput = os.Stdout })
+        sample, err := os.ReadFile("sample.config.yaml")
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                name   string
+                yaml   string
+                check  func(c Config) bool // Settings read despite the problems
+                errors []string
+        }{
+                {name: "sample", yaml: string(sample), check: func(c Config) bool { return c.Username == "@user:matrix.org" }},
+                {name: "empty file", yaml: "", check: func(c Config) bool { return reflect.DeepEqual(c, defaultConfig()) }},
+                {name: "known keys", yaml: "interval: 60\nprobe_concurrency: 8\n", check: func(c Config) bool { return c.Interval == 60 && c.ProbeConcurrency == 8 }},
+                {
+                        name:   "misspelt key",
+                        yaml:   "intervall: 60\nprobe_concurrency: 8\n",
+                        check:  func(c Config) bool { return c.Interval == defaultConfig().Interval && c.ProbeConcurrency == 8 },
+                        errors: []string{"line 1: field intervall not found"},
+                },
+                {
+                        name:   "unknown key and wrong type",
+                        yaml:   "interval: soon\nprobe_concurency: 8\n",
+                        check:  func(c Config) bool { return c.ProbeConcurrency == defaultConfig().ProbeConcurrency },
+                        errors: []string{"line 1: cannot unmarshal !!str `soon`", "line 2: field probe_concurency not found"},
+                },
+                {name: "invalid YAML", yaml: "interval: [60\n", errors: []string{"did not find expected"}},
+        }
+        for _, tt := range tests {
+                path := filepath.Join(t.TempDir(), "config.yaml")
+                if err := os.WriteFile(path, []byte(tt.yaml), 0600); err != nil {
+                        t.Fatal(err)
+                }
+                var problems []error
+                if err := loadConfig(path, false); err != nil {
+                        if joined, ok := err.(interface{ Unwrap() []error }); ok {
+                                problems = joined.Unwrap()
+                        } else {
+                                problems = []error{err}
+                        }
+                }
+                checkProblems(t, tt.name, problems, tt.errors)
+                if tt.check != nil && !tt.check(config) {
+                        t.Errorf("%s: configuration is %+v", tt.name, config)
+                }
+        }
+}
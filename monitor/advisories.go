@@ -0,0 +1,317 @@
+package monitor
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "os"
+        "sort"
+        "strconv"
+        "strings"
+
+        "gopkg.in/yaml.v3"
+)
+
+// Advisories: known problems of homeserver versions, matched against the software of every server
+// ==============================================================
+
+// Severities an advisory can have, from least to most severe
+var advisorySeverities = []string{"low", "medium", "high", "critical"}
+
+// Advisory describes a known problem of a range of versions of a homeserver implementation.
+// Advisories are shared between the tree and the inventory and are never modified.
+type Advisory struct {
+        ID             string `yaml:"id" json:"id"`
+        Implementation string `yaml:"implementation" json:"implementation"` // Server name as reported at /version, e.g. "Synapse"; case-insensitive
+        Versions       string `yaml:"versions" json:"versions"`             // Comma-separated constraints, e.g. ">=1.90.0, <1.95.1"; empty matches every version
+        Severity       string `yaml:"severity" json:"severity"`             // low, medium, high or critical
+        Description    string `yaml:"description" json:"description"`
+        URL            string `yaml:"url" json:"url,omitempty"`
+
+        constraints []versionConstraint
+}
+
+// advisoryFile is the layout of the advisory file
+type advisoryFile struct {
+        Advisories []*Advisory `yaml:"advisories"`
+}
+
+// LoadAdvisories reads and validates the advisory file at path
+func LoadAdvisories(path string) ([]*Advisory, error) {
+        data, err := os.ReadFile(path)
+        if err != nil {
+                return nil, err
+        }
+        advisories, err := ParseAdvisories(data)
+        if err != nil {
+                return nil, fmt.Errorf("invalid advisory file %s: %w", path, err)
+        }
+        return advisories, nil
+}
+
+// ParseAdvisories parses an advisory file, reporting every invalid advisory at once
+func ParseAdvisories(data []byte) ([]*Advisory, error) {
+        var file advisoryFile
+        if err := yaml.Unmarshal(data, &file); err != nil {
+                return nil, err
+        }
+
+        var errs []error
+        seen := make(map[string]bool)
+        for i, advisory := range file.Advisories {
+                if advisory == nil {
+                        errs = append(errs, fmt.Errorf("advisory %d is empty", i+1))
+                        continue
+                }
+                if advisory.ID == "" {
+                        advisory.ID = strings.TrimSpace(advisory.Implementation + " " + advisory.Versions)
+                }
+                if err := advisory.validate(); err != nil {
+                        errs = append(errs, fmt.Errorf("advisory %d (%s): %w", i+1, advisory.ID, err))
+                        continue
+                }
+                if seen[advisory.ID] {
+                        errs = append(errs, fmt.Errorf("advisory %d: duplicate id %q", i+1, advisory.ID))
+                }
+                seen[advisory.ID] = true
+        }
+        if len(errs) > 0 {
+                return nil, errors.Join(errs...)
+        }
+        return file.Advisories, nil
+}
+
+// validate checks the fields of an advisory and parses its version range
+func (a *Advisory) validate() error {
+        if a.Implementation == "" {
+                return errors.New("implementation is required")
+        }
+        a.Severity = strings.ToLower(a.Severity)
+        known := false
+        for _, severity := range advisorySeverities {
+                known = known || a.Severity == severity
+        }
+        if !known {
+                return fmt.Errorf("severity %q is not one of %s", a.Severity, strings.Join(advisorySeverities, ", "))
+        }
+
+        constraints, err := parseVersionRange(a.Versions)
+        if err != nil {
+                return err
+        }
+        a.constraints = constraints
+        return nil
+}
+
+// Matches reports whether the software is the implementation of the advisory in an affected version.
+// Software whose version cannot be parsed only matches advisories without a version range.
+func (a *Advisory) Matches(software *ServerSoftware) bool {
+        if software == nil || !strings.EqualFold(a.Implementation, software.Name) {
+                return false
+        }
+        if len(a.constraints) == 0 {
+                return true
+        }
+        version, ok := parseVersion(software.Version)
+        if !ok {
+                return false
+        }
+        for _, constraint := range a.constraints {
+                if !constraint.allows(version) {
+                        return false
+                }
+        }
+        return true
+}
+
+// matchAdvisories returns the advisories that apply to the software, most severe first
+func (m *Monitor) matchAdvisories(software *ServerSoftware) []*Advisory {
+        var matches []*Advisory
+        for _, advisory := range m.opts.Advisories {
+                if advisory.Matches(software) {
+                        matches = append(matches, advisory)
+                }
+        }
+        sort.SliceStable(matches, func(i, j int) bool {
+                return severityRank(matches[i].Severity) > severityRank(matches[j].Severity)
+        })
+        return matches
+}
+
+func severityRank(severity string) int {
+        for i, s := range advisorySeverities {
+                if s == severity {
+                        return i
+                }
+        }
+        return -1
+}
+
+// reportAdvisories tells the log room about servers that newly match advisories, with the users and
+// rooms affected. A server is reported again when the set of advisories it matches changes, but not
+// after a restart: the advisories last reported are saved with the latest check of every server.
+func (m *Monitor) reportAdvisories(ctx context.Context, reports map[ServerName]*serverReport) {
+        servers := make([]ServerName, 0, len(reports))
+        for server := range reports {
+                servers = append(servers, server)
+        }
+        sort.Slice(servers, func(i, j int) bool {
+                return servers[i].String() < servers[j].String()
+        })
+
+        for _, server := range servers {
+                var software *ServerSoftware
+                if s, ok := m.software.Load(server); ok {
+                        software = s.(*ServerSoftware)
+                }
+                matches := m.matchAdvisories(software)
+                ids := make([]string, len(matches))
+                for i, advisory := range matches {
+                        ids[i] = advisory.ID
+                }
+                key := strings.Join(ids, "\n")
+                if previous, ok := m.advisoryReports.Swap(server, key); (ok && previous.(string) == key) || (!ok && key == "") {
+                        continue
+                }
+                if len(matches) == 0 {
+                        fmt.Fprintf(m.opts.Logger, "Server %s no longer matches any advisory\n", server)
+                        continue
+                }
+
+                message := formatAdvisories(server, software, matches, reports[server])
+                fmt.Fprintln(m.opts.Logger, message)
+                if !m.opts.ReportAdvisories || m.opts.LogRoom == "" {
+                        continue
+                }
+                if err := m.sendMessageToRoom(ctx, m.opts.LogRoom, message); err != nil {
+                        fmt.Fprintf(m.opts.Logger, "Failed to send advisories for %s to log room: %v\n", server, err)
+                }
+        }
+}
+
+// reportedAdvisories returns the IDs of the advisories last reported for a server
+func (m *Monitor) reportedAdvisories(server ServerName) []string {
+        key, ok := m.advisoryReports.Load(server)
+        if !ok || key.(string) == "" {
+                return nil
+        }
+        return strings.Split(key.(string), "\n")
+}
+
+// formatAdvisories builds the log room message for a server that matches advisories
+func formatAdvisories(server ServerName, software *ServerSoftware, matches []*Advisory, report *serverReport) string {
+        var sb strings.Builder
+        fmt.Fprintf(&sb, "Server %s runs %s, which has %d known advisories:\n", server, software, len(matches))
+        for _, advisory := range matches {
+                fmt.Fprintf(&sb, "- [%s] %s: %s", advisory.Severity, advisory.ID, advisory.Description)
+                if advisory.URL != "" {
+                        fmt.Fprintf(&sb, " (%s)", advisory.URL)
+                }
+                sb.WriteString("\n")
+        }
+        if report != nil {
+                rooms := append([]string(nil), report.Rooms...)
+                sort.Strings(rooms)
+                fmt.Fprintf(&sb, "Affected: %d users in %d rooms:\n", report.UserCount, len(rooms))
+                for _, room := range rooms {
+                        fmt.Fprintf(&sb, "- %s\n", room)
+                }
+        }
+        return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// versionConstraint is one comparison of a version range, e.g. "<1.95.1"
+type versionConstraint struct {
+        op      string
+        version []int
+}
+
+// parseVersionRange parses comma-separated constraints using <, <=, >, >=, = and !=
+func parseVersionRange(s string) ([]versionConstraint, error) {
+        var constraints []versionConstraint
+        for _, part := range strings.Split(s, ",") {
+                part = strings.TrimSpace(part)
+                if part == "" {
+                        continue
+                }
+                op := "="
+                for _, candidate := range []string{"<=", ">=", "!=", "<", ">", "="} {
+                        if strings.HasPrefix(part, candidate) {
+                                op = candidate
+                                break
+                        }
+                }
+                raw := strings.TrimSpace(strings.TrimPrefix(part, op))
+                version, ok := parseVersion(raw)
+                if !ok {
+                        return nil, fmt.Errorf("invalid version %q in range %q", raw, s)
+                }
+                constraints = append(constraints, versionConstraint{op: op, version: version})
+        }
+        return constraints, nil
+}
+
+// allows reports whether version satisfies the constraint
+func (c versionConstraint) allows(version []int) bool {
+        cmp := compareVersions(version, c.version)
+        switch c.op {
+        case "<":
+                return cmp < 0
+        case "<=":
+                return cmp <= 0
+        case ">":
+                return cmp > 0
+        case ">=":
+                return cmp >= 0
+        case "!=":
+                return cmp != 0
+        default:
+                return cmp == 0
+        }
+}
+
+// parseVersion takes the dotted numbers at the start of a version string, so "v1.98.0rc1" and
+// "1.98.0 (abc123)" are both 1.98.0. Pre-release and build suffixes are ignored.
+func parseVersion(s string) ([]int, bool) {
+        s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+        end := strings.IndexFunc(s, func(r rune) bool {
+                return (r < '0' || r > '9') && r != '.'
+        })
+        if end >= 0 {
+                s = s[:end]
+        }
+        s = strings.TrimSuffix(s, ".")
+        if s == "" {
+                return nil, false
+        }
+
+        var version []int
+        for _, part := range strings.Split(s, ".") {
+                n, err := strconv.Atoi(part)
+                if err != nil {
+                        return nil, false
+                }
+                version = append(version, n)
+        }
+        return version, true
+}
+
+// compareVersions compares dotted versions numerically, treating missing parts as 0
+func compareVersions(a, b []int) int {
+        for i := 0; i < len(a) || i < len(b); i++ {
+                var x, y int
+                if i < len(a) {
+                        x = a[i]
+                }
+                if i < len(b) {
+                        y = b[i]
+                }
+                if x != y {
+                        if x < y {
+                                return -1
+                        }
+                        return 1
+                }
+        }
+        return 0
+}
@@ -0,0 +1,123 @@
+package monitor
+
+import (
+        "reflect"
+        "strings"
+        "testing"
+)
+
+func TestParseVersionRange(t *testing.T) {
+        tests := []struct {
+                in      string
+                want    []versionConstraint
+                wantErr bool
+        }{
+                {in: "", want: nil},
+                {in: "1.2.3", want: []versionConstraint{{"=", []int{1, 2, 3}}}},
+                {in: "=1.2", want: []versionConstraint{{"=", []int{1, 2}}}},
+                {in: "<1.95.1", want: []versionConstraint{{"<", []int{1, 95, 1}}}},
+                {in: ">=1.90.0, <1.95.1", want: []versionConstraint{{">=", []int{1, 90, 0}}, {"<", []int{1, 95, 1}}}},
+                {in: "<= 2 , > 1,", want: []versionConstraint{{"<=", []int{2}}, {">", []int{1}}}},
+                {in: "!=v1.0.0rc1", want: []versionConstraint{{"!=", []int{1, 0, 0}}}},
+
+                {in: "<", wantErr: true},
+                {in: ">=latest", wantErr: true},
+                {in: "~1.2", wantErr: true},
+        }
+        for _, tt := range tests {
+                got, err := parseVersionRange(tt.in)
+                if tt.wantErr {
+                        if err == nil {
+                                t.Errorf("parseVersionRange(%q) = %v, want an error", tt.in, got)
+                        }
+                        continue
+                }
+                if err != nil {
+                        t.Errorf("parseVersionRange(%q) failed: %v", tt.in, err)
+                        continue
+                }
+                if !reflect.DeepEqual(got, tt.want) {
+                        t.Errorf("parseVersionRange(%q) = %v, want %v", tt.in, got, tt.want)
+                }
+        }
+}
+
+func TestAdvisoryMatches(t *testing.T) {
+        tests := []struct {
+                implementation string
+                versions       string
+                software       *ServerSoftware
+                want           bool
+        }{
+                {"Synapse", ">=1.90.0, <1.95.1", &ServerSoftware{"Synapse", "1.90.0"}, true},
+                {"Synapse", ">=1.90.0, <1.95.1", &ServerSoftware{"Synapse", "1.95.0"}, true},
+                {"Synapse", ">=1.90.0, <1.95.1", &ServerSoftware{"Synapse", "1.95.1"}, false},
+                {"Synapse", ">=1.90.0, <1.95.1", &ServerSoftware{"Synapse", "1.89.9"}, false},
+                {"Synapse", ">=1.90.0, <1.95.1", &ServerSoftware{"Synapse", "1.95"}, true},         // Missing parts count as 0
+                {"Synapse", "<1.95.1", &ServerSoftware{"Synapse", "1.95.0rc1"}, true},              // Suffixes are ignored
+                {"Synapse", "<1.95.1", &ServerSoftware{"Synapse", "1.10.0 (b=main,abc123)"}, true}, // Compared numerically
+                {"Synapse", "!=1.0", &ServerSoftware{"Synapse", "1.0.0"}, false},
+                {"synapse", "<2", &ServerSoftware{"Synapse", "1.0"}, true}, // Implementation names are case-insensitive
+                {"Synapse", "<2", &ServerSoftware{"Dendrite", "1.0"}, false},
+                {"Synapse", "<2", &ServerSoftware{"Synapse", "unknown"}, false},
+                {"Synapse", "", &ServerSoftware{"Synapse", "unknown"}, true}, // No range matches every version
+                {"Synapse", "", nil, false},
+        }
+        for _, tt := range tests {
+                advisory := &Advisory{Implementation: tt.implementation, Versions: tt.versions, Severity: "high"}
+                if err := advisory.validate(); err != nil {
+                        t.Fatalf("advisory for %s %q is invalid: %v", tt.implementation, tt.versions, err)
+                }
+                if got := advisory.Matches(tt.software); got != tt.want {
+                        t.Errorf("advisory for %s %q matches %s: %v, want %v", tt.implementation, tt.versions, tt.software, got, tt.want)
+                }
+        }
+}
+
+func TestParseAdvisories(t *testing.T) {
+        advisories, err := ParseAdvisories([]byte(`
+advisories:
+  - id: SYN-1
+    implementation: Synapse
+    versions: "<1.95.1"
+    severity: High
+    description: Example
+  - implementation: Dendrite
+    versions: "<0.13"
+    severity: low
+`))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(advisories) != 2 || advisories[0].Severity != "high" || advisories[1].ID != "Dendrite <0.13" {
+                t.Errorf("ParseAdvisories returned %+v %+v", advisories[0], advisories[1])
+        }
+
+        // Every invalid advisory is reported at once
+        _, err = ParseAdvisories([]byte(`
+advisories:
+  - id: A
+    severity: high
+  - id: B
+    implementation: Synapse
+    severity: urgent
+  - id: C
+    implementation: Synapse
+    versions: "<one"
+    severity: low
+  - id: D
+    implementation: Synapse
+    severity: low
+  - id: D
+    implementation: Dendrite
+    severity: low
+`))
+        if err == nil {
+                t.Fatal("ParseAdvisories accepted invalid advisories")
+        }
+        for _, want := range []string{"advisory 1 (A)", "advisory 2 (B)", "advisory 3 (C)", `advisory 5: duplicate id "D"`} {
+                if !strings.Contains(err.Error(), want) {
+                        t.Errorf("error %q does not mention %q", err, want)
+                }
+        }
+}
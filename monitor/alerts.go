@@ -0,0 +1,142 @@
+package monitor
+
+import (
+        "context"
+        "fmt"
+        "sort"
+        "strings"
+        "time"
+
+        "maunium.net/go/mautrix/id"
+)
+
+// Status change and certificate expiry messages in the log room
+// ==============================================================
+
+// serverReport aggregates the result of one check cycle for a single server across all rooms
+type serverReport struct {
+        Status    string
+        Rooms     []string
+        UserCount int
+}
+
+// add records one more room the server is in, creating the report on first use
+func (r *serverReport) add(room string, userCount int, status string) *serverReport {
+        if r == nil {
+                r = &serverReport{Status: status}
+        }
+        r.Rooms = append(r.Rooms, room)
+        r.UserCount += userCount
+        return r
+}
+
+// isStatusOK reports whether a status string returned by checkServer means the server is reachable
+func isStatusOK(status string) bool {
+        return status == "OK"
+}
+
+// isStatusDegraded reports whether a status string means the server answered, but wrongly
+func isStatusDegraded(status string) bool {
+        return strings.HasPrefix(status, "Degraded")
+}
+
+// reportStatusChanges compares this cycle's results with the previous ones and posts a message
+// to the log room for every server that went from OK to failed or back
+func (m *Monitor) reportStatusChanges(ctx context.Context, reports map[ServerName]*serverReport) {
+        servers := make([]ServerName, 0, len(reports))
+        for server := range reports {
+                servers = append(servers, server)
+        }
+        sort.Slice(servers, func(i, j int) bool {
+                return servers[i].String() < servers[j].String()
+        })
+
+        for _, server := range servers {
+                report := reports[server]
+                previous, seen := m.statuses.Swap(server, report.Status)
+                changed := seen && isStatusOK(previous.(string)) != isStatusOK(report.Status)
+                m.metrics.recordStatusChange(server, changed)
+                if !changed {
+                        continue
+                }
+
+                message := formatStatusChange(server, previous.(string), report)
+                fmt.Fprintln(m.opts.Logger, message)
+                if m.opts.LogRoom == "" {
+                        continue
+                }
+                if err := m.sendMessageToRoom(ctx, m.opts.LogRoom, message); err != nil {
+                        fmt.Fprintf(m.opts.Logger, "Failed to send status change for %s to log room: %v\n", server, err)
+                }
+        }
+}
+
+// reportCertificateExpiry warns the log room once about every working certificate that expires within
+// CertExpiryWarning. Expired certificates make the check fail and are reported as a status change instead.
+// A renewed certificate that is about to expire again is warned about again. The warnings given before a
+// restart are known again from the restored state, see restoreState.
+func (m *Monitor) reportCertificateExpiry(ctx context.Context, results map[ServerName]CheckResult) {
+        now := m.opts.Clock.Now()
+        servers := make([]ServerName, 0, len(results))
+        for server := range results {
+                servers = append(servers, server)
+        }
+        sort.Slice(servers, func(i, j int) bool {
+                return servers[i].String() < servers[j].String()
+        })
+
+        for _, server := range servers {
+                result := results[server]
+                expiresIn, ok := result.TLS.ExpiresIn(now)
+                if !ok || !result.Check.OK() || expiresIn > m.opts.CertExpiryWarning {
+                        continue
+                }
+
+                leaf := result.TLS.Leaf()
+                if warned, ok := m.certWarnings.Load(server); ok && warned.(time.Time).Equal(leaf.NotAfter) {
+                        continue
+                }
+                m.certWarnings.Store(server, leaf.NotAfter)
+
+                message := fmt.Sprintf("Certificate of server %s expires in %d days, on %s (issuer: %s).",
+                        server, int(expiresIn.Hours()/24), leaf.NotAfter.UTC().Format("2006-01-02 15:04 MST"), leaf.Issuer)
+                fmt.Fprintln(m.opts.Logger, message)
+                if m.opts.LogRoom == "" {
+                        continue
+                }
+                if err := m.sendMessageToRoom(ctx, m.opts.LogRoom, message); err != nil {
+                        fmt.Fprintf(m.opts.Logger, "Failed to send certificate warning for %s to log room: %v\n", server, err)
+                }
+        }
+}
+
+// formatStatusChange builds the log room message for a server whose status changed
+func formatStatusChange(server ServerName, previous string, report *serverReport) string {
+        rooms := append([]string(nil), report.Rooms...)
+        sort.Strings(rooms)
+
+        var sb strings.Builder
+        if isStatusOK(report.Status) {
+                fmt.Fprintf(&sb, "Server %s is back online (was: %s).\n", server, previous)
+        } else if isStatusDegraded(report.Status) {
+                fmt.Fprintf(&sb, "Server %s answers, but is misconfigured: %s.\n", server, report.Status)
+        } else {
+                fmt.Fprintf(&sb, "Server %s is down: %s.\n", server, report.Status)
+        }
+        fmt.Fprintf(&sb, "Affected: %d users in %d rooms:\n", report.UserCount, len(rooms))
+        for _, room := range rooms {
+                fmt.Fprintf(&sb, "- %s\n", room)
+        }
+        return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// sendMessageToRoom sends a message to a Matrix room, unless the monitor is silent
+func (m *Monitor) sendMessageToRoom(ctx context.Context, roomID id.RoomID, message string) error {
+        if m.opts.Silent {
+                return nil
+        }
+        return m.apiLimit.Do(ctx, func() error {
+                _, err := m.opts.Client.SendText(ctx, roomID, message)
+                return err
+        })
+}
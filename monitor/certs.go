@@ -0,0 +1,147 @@
+package monitor
+
+import (
+        "crypto/tls"
+        "crypto/x509"
+        "fmt"
+        "net"
+        "sync"
+        "time"
+)
+
+// TLS certificate inspection of federation endpoints
+// ==============================================================
+
+// DefaultCertExpiryWarning is how long before a certificate expires the log room is warned
+const DefaultCertExpiryWarning = 14 * 24 * time.Hour
+
+// CertificateInfo describes one certificate of the chain a server presented
+type CertificateInfo struct {
+        Subject     string    `json:"subject"`
+        Issuer      string    `json:"issuer"`
+        DNSNames    []string  `json:"dns_names,omitempty"`
+        IPAddresses []string  `json:"ip_addresses,omitempty"`
+        NotBefore   time.Time `json:"not_before"`
+        NotAfter    time.Time `json:"not_after"`
+        SelfSigned  bool      `json:"self_signed,omitempty"`
+}
+
+// TLSInfo is what a probe learned about the TLS connection to a server.
+// It is never modified once the probe returns.
+type TLSInfo struct {
+        Version      string            `json:"version"`     // Negotiated protocol version, e.g. "TLS 1.3"
+        ServerName   string            `json:"server_name"` // Name the certificate has to be valid for
+        ValidForName bool              `json:"valid_for_name"`
+        Chain        []CertificateInfo `json:"chain"`                  // Leaf first, as sent by the server
+        VerifyError  string            `json:"verify_error,omitempty"` // Why the chain was rejected, empty when valid
+}
+
+// Leaf returns the certificate of the server itself, or nil if none was presented
+func (t *TLSInfo) Leaf() *CertificateInfo {
+        if t == nil || len(t.Chain) == 0 {
+                return nil
+        }
+        return &t.Chain[0]
+}
+
+// ExpiresIn returns the time left until the leaf certificate expires, negative once it has
+func (t *TLSInfo) ExpiresIn(now time.Time) (time.Duration, bool) {
+        leaf := t.Leaf()
+        if leaf == nil {
+                return 0, false
+        }
+        return leaf.NotAfter.Sub(now), true
+}
+
+// certInspector verifies the peer certificates of a probe the way crypto/tls would, and records
+// them along the way, so that the chain is known even when the handshake fails because of it
+type certInspector struct {
+        serverName string
+        roots      *x509.CertPool // nil means the system roots
+        skipVerify bool           // Set when the transport template disables verification
+
+        mu   sync.Mutex
+        info *TLSInfo
+}
+
+// inspectCertificates sets up config so that the certificates are recorded and verified by the returned inspector
+func inspectCertificates(config *tls.Config, serverName string) *certInspector {
+        inspector := &certInspector{
+                serverName: serverName,
+                roots:      config.RootCAs,
+                skipVerify: config.InsecureSkipVerify,
+        }
+        config.ServerName = serverName
+        config.InsecureSkipVerify = true // Verification happens in VerifyConnection instead
+        config.VerifyConnection = inspector.verify
+        return inspector
+}
+
+// verify is the VerifyConnection callback: it records the connection state, then verifies the chain
+func (c *certInspector) verify(state tls.ConnectionState) error {
+        info := &TLSInfo{
+                Version:    tls.VersionName(state.Version),
+                ServerName: c.serverName,
+        }
+        for _, cert := range state.PeerCertificates {
+                info.Chain = append(info.Chain, newCertificateInfo(cert))
+        }
+
+        var err error
+        if len(state.PeerCertificates) == 0 {
+                err = fmt.Errorf("server %s presented no certificate", c.serverName)
+        } else {
+                leaf := state.PeerCertificates[0]
+                info.ValidForName = leaf.VerifyHostname(c.serverName) == nil
+
+                intermediates := x509.NewCertPool()
+                for _, cert := range state.PeerCertificates[1:] {
+                        intermediates.AddCert(cert)
+                }
+                _, err = leaf.Verify(x509.VerifyOptions{
+                        DNSName:       c.serverName,
+                        Roots:         c.roots,
+                        Intermediates: intermediates,
+                })
+        }
+        if err != nil {
+                info.VerifyError = err.Error()
+        }
+
+        c.mu.Lock()
+        c.info = info
+        c.mu.Unlock()
+
+        if c.skipVerify {
+                return nil
+        }
+        return err
+}
+
+// Info returns what was recorded during the handshake, or nil if it never got that far
+func (c *certInspector) Info() *TLSInfo {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        return c.info
+}
+
+// newCertificateInfo extracts the fields worth showing from a certificate
+func newCertificateInfo(cert *x509.Certificate) CertificateInfo {
+        info := CertificateInfo{
+                Subject:    cert.Subject.String(),
+                Issuer:     cert.Issuer.String(),
+                DNSNames:   cert.DNSNames,
+                NotBefore:  cert.NotBefore,
+                NotAfter:   cert.NotAfter,
+                SelfSigned: isSelfSigned(cert),
+        }
+        for _, ip := range cert.IPAddresses {
+                info.IPAddresses = append(info.IPAddresses, net.IP.String(ip))
+        }
+        return info
+}
+
+// isSelfSigned reports whether a certificate is signed by its own key
+func isSelfSigned(cert *x509.Certificate) bool {
+        return cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,348 @@
+package monitor
+
+import (
+        "context"
+        "crypto/tls"
+        "encoding/json"
+        "fmt"
+        "io"
+        "mime"
+        "net"
+        "net/http"
+        "net/http/httptrace"
+        "strings"
+        "sync"
+        "time"
+)
+
+// Check cycles: probe every server found in the tracked rooms once per interval
+// ==============================================================
+
+// runServerCheckLoop performs checks for offline servers at the specified interval
+func (m *Monitor) runServerCheckLoop(ctx context.Context) {
+        // Wait until the first sync has told us which rooms we are in
+        fmt.Fprintln(m.opts.Logger, "Waiting for the first sync...")
+        select {
+        case <-m.membership.Ready():
+        case <-ctx.Done():
+                return
+        }
+
+        for {
+                if !m.runCheckCycle(ctx) {
+                        return
+                }
+
+                // Wait for the specified interval before checking again
+                fmt.Fprintf(m.opts.Logger, "Waiting for %s\n", m.opts.Interval)
+                if !m.waitInterval(ctx) {
+                        return
+                }
+        }
+}
+
+// runCheckCycle checks every server of the tracked rooms once, updates the tree and reports the changes.
+// It returns false if ctx was cancelled during the cycle.
+func (m *Monitor) runCheckCycle(ctx context.Context) bool {
+        fmt.Fprintln(m.opts.Logger, "Checking server statuses...")
+        cycleStart := time.Now()
+        now := m.opts.Clock.Now()
+
+        // Take the servers of every room from the membership kept current by the sync loop,
+        // then drop whatever has been gone for longer than the grace period
+        roomServers := m.collectRoomServers(ctx)
+        m.reconcileTree(now)
+
+        // Probe every distinct server once, no matter how many rooms it is in
+        results := m.probeServers(ctx, roomServers)
+
+        // Results of a cancelled cycle are not real failures; drop them
+        if ctx.Err() != nil {
+                fmt.Fprintln(m.opts.Logger, "Check cycle cancelled")
+                return false
+        }
+
+        // Only a status seen for enough cycles in a row is confirmed; the tree, alerts and
+        // the server_up metric follow the confirmed status
+        m.dampResults(results)
+
+        // Count the cycle in the uptime of every server and room
+        roomSamples := m.recordUptime(now, roomServers, results)
+
+        // Share each result with every room node that contains the server, in a single update
+        // so that /tree shows the whole cycle at once
+        reports := make(map[ServerName]*serverReport)
+        m.tree.Update(func(rooms map[string]*TreeNode) {
+                for _, sample := range roomSamples {
+                        if roomNode, ok := rooms[sample.RoomID]; ok {
+                                roomNode.Uptime = m.uptime.room(sample.RoomID, now)
+                        }
+                }
+                for _, rs := range roomServers {
+                        result := results[rs.Server]
+                        status := result.Confirmed
+                        reports[rs.Server] = reports[rs.Server].add(rs.RoomName, rs.UserCount, status)
+
+                        // Skip servers that left the room while the probes were running
+                        roomNode, ok := rooms[rs.RoomID]
+                        if !ok {
+                                continue
+                        }
+                        serverNode := findServerNode(roomNode, rs.Server)
+                        if serverNode == nil || serverNode.DepartedAt != nil {
+                                continue
+                        }
+
+                        fmt.Fprintf(m.opts.Logger, "Server %s in room %s: Status %s -> %s\n", rs.Server, rs.RoomName, serverNode.Status, status)
+                        serverNode.Status = status
+                        serverNode.Suspect = result.Suspect
+                        check, timings := result.Check, result.Timings
+                        serverNode.Check = &check
+                        serverNode.Timings = &timings
+                        serverNode.TLS = result.TLS
+                        serverNode.Keys = result.Keys
+                        if result.Software != nil {
+                                serverNode.Software = result.Software
+                        }
+                        serverNode.Advisories = m.matchAdvisories(serverNode.Software)
+                        serverNode.Uptime = m.uptime.server(rs.Server, now)
+                }
+        })
+
+        // Export the results of this cycle as Prometheus metrics
+        m.metrics.recordCycleMetrics(results, roomServers, time.Since(cycleStart))
+
+        // Tell the log room about servers that went down or came back
+        m.reportStatusChanges(ctx, reports)
+        m.reportCertificateExpiry(ctx, results)
+        m.reportSoftwareChanges(ctx, results)
+        m.reportAdvisories(ctx, reports)
+
+        // Keep the results for Results, and save them and the tree so they survive a restart
+        cycleResults := make([]CheckResult, 0, len(results))
+        for server, result := range results {
+                result.Advisories = m.reportedAdvisories(server)
+                results[server] = result
+                cycleResults = append(cycleResults, result)
+        }
+        m.resultsMu.Lock()
+        m.results = results
+        m.resultsMu.Unlock()
+        if m.opts.Store != nil {
+                if err := m.saveState(cycleResults, roomSamples); err != nil {
+                        fmt.Fprintln(m.opts.Logger, "Failed to save check history:", err)
+                }
+        }
+
+        // Hand the results to the embedding program
+        if m.opts.OnResults != nil {
+                m.opts.OnResults(cycleResults)
+        }
+        return true
+}
+
+// waitInterval sleeps for the configured interval. It returns false if ctx was cancelled first.
+func (m *Monitor) waitInterval(ctx context.Context) bool {
+        select {
+        case <-ctx.Done():
+                return false
+        case <-m.opts.Clock.After(m.opts.Interval):
+                return true
+        }
+}
+
+// roomServer is a server with members in a room, as seen at the start of a cycle
+type roomServer struct {
+        RoomID    string
+        RoomName  string
+        Server    ServerName
+        UserCount int
+}
+
+// probeServers checks each distinct server found in this cycle exactly once, with at most ProbeConcurrency probes in flight
+func (m *Monitor) probeServers(ctx context.Context, roomServers []roomServer) map[ServerName]CheckResult {
+        seen := make(map[ServerName]bool)
+        var servers []ServerName
+        for _, rs := range roomServers {
+                if !seen[rs.Server] {
+                        seen[rs.Server] = true
+                        servers = append(servers, rs.Server)
+                }
+        }
+
+        results := make(map[ServerName]CheckResult, len(servers))
+        var mu sync.Mutex
+        forEachLimited(servers, m.opts.ProbeConcurrency, func(server ServerName) {
+                result := m.checkServerWithRetries(ctx, server)
+
+                mu.Lock()
+                results[server] = result
+                mu.Unlock()
+        })
+
+        fmt.Fprintf(m.opts.Logger, "Probed %d servers\n", len(servers))
+        return results
+}
+
+// CheckResult is the outcome of checking one server
+type CheckResult struct {
+        Server   ServerName
+        Time     time.Time       // When the check started
+        Check    ProbeStatus     // Typed outcome of the check
+        Status   string          // Check formatted as text: "OK", "Degraded (<summary>)" or "Failed (<summary>)"
+        Attempts int             // Checks made in this cycle, more than one when transient failures were retried
+        Latency  time.Duration   // Time taken by resolution and probe together
+        Timings  ProbeTimings    // Time taken by each phase of the check
+        TLS      *TLSInfo        // Certificates and TLS version, nil if the probe did not get to the handshake
+        Keys     *ProbeStatus    // Outcome of the signing key check, nil if the version check failed
+        Software *ServerSoftware // Implementation and version reported by the server, nil if unknown
+
+        // Status after flap damping, as shown in the tree. It follows Status only once enough checks
+        // in a row agree. Suspect is set while Confirmed is OK, but the last checks failed.
+        Confirmed string
+        Suspect   bool
+
+        // IDs of the advisories the server matches as last reported, saved so that a restart does not report them again
+        Advisories []string
+}
+
+// CheckServer resolves and checks the online status of a server
+func (m *Monitor) CheckServer(ctx context.Context, server ServerName) CheckResult {
+        result := CheckResult{Server: server, Time: m.opts.Clock.Now()}
+        start := time.Now()
+
+        // Discovery as a whole gets the probe timeout; the probe and key requests get their own
+        discoveryCtx, cancel := context.WithTimeout(ctx, m.opts.ProbeTimeout)
+        matrixServer, err := m.resolveMatrixServer(discoveryCtx, server, nil)
+        cancel()
+        return m.checkResolvedServer(ctx, result, start, matrixServer, err)
+}
+
+// checkResolvedServer finishes a check once server discovery has resolved the server, or failed with err.
+// start is when discovery began, so that the timings include it.
+func (m *Monitor) checkResolvedServer(ctx context.Context, result CheckResult, start time.Time, matrixServer resolvedServer, err error) CheckResult {
+        server := result.Server
+        delegation := time.Since(start)
+        if err != nil {
+                result.Check = classifyResolveError(err)
+        } else {
+                probe := m.checkServerOnline(ctx, matrixServer)
+                result.Check, result.Timings, result.TLS, result.Software = probe.Status, probe.Timings, probe.TLS, probe.Software
+
+                // A server that answers can still be unable to federate because of its keys
+                if result.Check.OK() {
+                        keys := m.checkSigningKeys(ctx, matrixServer, server)
+                        result.Keys = &keys
+                }
+        }
+
+        result.Timings.Delegation = delegation
+        result.Timings.Total = time.Since(start)
+        result.Latency = result.Timings.Total
+        result.Status = result.Check.String()
+        return result
+}
+
+// extractDomain extracts and parses the server name part of a Matrix UserID.
+// The server name starts after the first ":" and may itself contain a port or an IPv6 literal.
+func extractDomain(userID string) (ServerName, error) {
+        _, server, found := strings.Cut(userID, ":")
+        if !found {
+                return ServerName{}, fmt.Errorf("no server name in user ID %q", userID)
+        }
+        return ParseServerName(server)
+}
+
+// probeResult is what a single probe request found out
+type probeResult struct {
+        Status   ProbeStatus
+        Timings  ProbeTimings
+        TLS      *TLSInfo
+        Software *ServerSoftware
+}
+
+// checkServerOnline checks if a server is online by sending a GET request to the Matrix federation version endpoint.
+// The connection goes to the resolved address while the Host header and SNI carry the resolved host name.
+func (m *Monitor) checkServerOnline(ctx context.Context, server resolvedServer) probeResult {
+        url := fmt.Sprintf("https://%s/_matrix/federation/v1/version", server.Host)
+        transport, certs := m.probeTransport(server)
+        client := &http.Client{
+                Timeout:   m.opts.ProbeTimeout,
+                Transport: transport,
+        }
+
+        // Follow the progress of the request, to time each phase and attribute a failure to the step it happened in
+        progress := newProbeProgress()
+        req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, progress.trace()), http.MethodGet, url, nil)
+        if err != nil {
+                return probeResult{Status: classifyError(StepHTTP, err)}
+        }
+
+        resp, err := client.Do(req)
+        if err != nil {
+                fmt.Fprintf(m.opts.Logger, "Failed to reach server %s (%s): %v\n", server.Host, server.Address, err)
+                return probeResult{Status: classifyError(progress.Step(), err), Timings: progress.Timings(), TLS: certs.Info()}
+        }
+        defer resp.Body.Close()
+
+        // The server answered; make sure the answer is a version and not an error page
+        status, software := validateVersionResponse(resp)
+        if !status.OK() {
+                fmt.Fprintf(m.opts.Logger, "Unexpected response from server %s: %s\n", server.Host, status.Summary())
+        }
+        return probeResult{Status: status, Timings: progress.Timings(), TLS: certs.Info(), Software: software}
+}
+
+const versionMaxBodySize = 64 * 1024
+
+// validateVersionResponse checks that a version response has a 2xx status, a JSON Content-Type and
+// a JSON object with a server member. Anything else means a proxy or the homeserver is misconfigured.
+func validateVersionResponse(resp *http.Response) (ProbeStatus, *ServerSoftware) {
+        var body map[string]interface{}
+        decodeErr := json.NewDecoder(io.LimitReader(resp.Body, versionMaxBodySize)).Decode(&body)
+
+        // Matrix errors such as M_UNRECOGNIZED come with an error status, but say more than it
+        errcode, _ := body["errcode"].(string)
+        if errcode != "" {
+                message, _ := body["error"].(string)
+                return failedStatus(CategoryDegraded, CodeMatrixError, StepHTTP, strings.TrimSuffix(fmt.Sprintf("%s: %s: %s", resp.Status, errcode, message), ": ")), nil
+        }
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                return failedStatus(CategoryDegraded, CodeHTTPStatus, StepHTTP, resp.Status), nil
+        }
+
+        contentType := resp.Header.Get("Content-Type")
+        if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+                return failedStatus(CategoryDegraded, CodeBadContentType, StepHTTP, fmt.Sprintf("Content-Type %q", contentType)), nil
+        }
+        if decodeErr != nil {
+                return failedStatus(CategoryDegraded, CodeInvalidJSON, StepHTTP, decodeErr.Error()), nil
+        }
+        if _, ok := body["server"].(map[string]interface{}); !ok {
+                return failedStatus(CategoryDegraded, CodeNoServerInfo, StepHTTP, "no server object in the response"), nil
+        }
+        return statusOK, softwareFromVersion(body)
+}
+
+// probeTransport derives the transport of a probe from Options.Transport. It dials the resolved
+// address, whatever the URL says, and checks the certificate against the resolved host name
+// with the returned inspector, which keeps the certificates for the result.
+func (m *Monitor) probeTransport(server resolvedServer) (*http.Transport, *certInspector) {
+        transport := m.opts.Transport.Clone()
+
+        dial := transport.DialContext
+        if dial == nil {
+                dial = (&net.Dialer{Timeout: m.opts.ProbeTimeout}).DialContext
+        }
+        transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+                return dial(ctx, network, server.Address)
+        }
+
+        if transport.TLSClientConfig == nil {
+                transport.TLSClientConfig = &tls.Config{}
+        }
+        certs := inspectCertificates(transport.TLSClientConfig, server.TLSServerName())
+        transport.DisableKeepAlives = true
+        transport.Proxy = nil
+        return transport, certs
+}
@@ -0,0 +1,59 @@
+package monitor
+
+import (
+        "context"
+        "fmt"
+        "strings"
+
+        "maunium.net/go/mautrix/event"
+)
+
+// Bot commands, accepted in the log room only so that monitored rooms are not spammed
+// ==============================================================
+
+// handleCommand runs a command sent to the log room, such as "!delegation example.org"
+func (m *Monitor) handleCommand(ctx context.Context, evt *event.Event) {
+        if m.opts.LogRoom == "" || evt.RoomID != m.opts.LogRoom {
+                return
+        }
+        content := evt.Content.AsMessage()
+        if content == nil || content.MsgType != event.MsgText {
+                return
+        }
+        fields := strings.Fields(content.Body)
+        if len(fields) == 0 || !strings.HasPrefix(fields[0], "!") {
+                return
+        }
+
+        switch fields[0] {
+        case "!delegation":
+                if len(fields) != 2 {
+                        m.replyToCommand(ctx, "Usage: !delegation <server name>")
+                        return
+                }
+                server, err := ParseServerName(fields[1])
+                if err != nil {
+                        m.replyToCommand(ctx, fmt.Sprintf("Invalid server name: %v", err))
+                        return
+                }
+
+                // Discovery can take a while; don't hold up the sync loop, but don't start more
+                // diagnoses than /delegation may either
+                if !m.acquireDiagnosis() {
+                        m.replyToCommand(ctx, ErrDiagnosesBusy.Error())
+                        return
+                }
+                fmt.Fprintf(m.opts.Logger, "Diagnosing delegation of %s for %s\n", server, evt.Sender)
+                go func() {
+                        defer m.releaseDiagnosis()
+                        m.replyToCommand(ctx, m.diagnoseDelegation(ctx, server).Format())
+                }()
+        }
+}
+
+// replyToCommand sends the answer to a command to the log room
+func (m *Monitor) replyToCommand(ctx context.Context, message string) {
+        if err := m.sendMessageToRoom(ctx, m.opts.LogRoom, message); err != nil {
+                fmt.Fprintf(m.opts.Logger, "Failed to answer command in log room: %v\n", err)
+        }
+}
@@ -0,0 +1,133 @@
+package monitor
+
+import (
+        "context"
+        "sync"
+        "time"
+)
+
+// Flap damping: retries within a cycle, and thresholds before a server is marked down or up again
+// ==============================================================
+
+const (
+        DefaultFailureThreshold  = 2
+        DefaultRecoveryThreshold = 1
+        DefaultProbeRetries      = 2
+        DefaultRetryBackoff      = 2 * time.Second
+)
+
+// isTransient reports whether a failure may go away when the check is retried a moment later.
+// A server that answered, or a certificate that is wrong, gives the same result again.
+func isTransient(status ProbeStatus) bool {
+        switch status.Category {
+        case CategoryConnection, CategoryHTTP:
+                return true
+        }
+        switch status.Code {
+        case CodeDNSTimeout, CodeDNSError, CodeTLSHandshakeFailed:
+                return true
+        }
+        return false
+}
+
+// checkServerWithRetries checks a server, retrying transient failures up to ProbeRetries times.
+// The wait before each retry starts at RetryBackoff and doubles every time.
+func (m *Monitor) checkServerWithRetries(ctx context.Context, server ServerName) CheckResult {
+        backoff := m.opts.RetryBackoff
+        for attempt := 1; ; attempt++ {
+                result := m.CheckServer(ctx, server)
+                result.Attempts = attempt
+                if result.Check.OK() || !isTransient(result.Check) || attempt > m.opts.ProbeRetries {
+                        return result
+                }
+
+                select {
+                case <-ctx.Done():
+                        return result
+                case <-m.opts.Clock.After(backoff):
+                }
+                backoff *= 2
+        }
+}
+
+// dampedState is the confirmed status of a server and the checks in a row that disagree with it
+type dampedState struct {
+        Confirmed string
+        Failures  int // Failed checks in a row while Confirmed is OK
+        Successes int // OK checks in a row while Confirmed is a failure
+}
+
+// flapDamper confirms a status change only once FailureThreshold failed checks, or RecoveryThreshold
+// OK checks, come in a row. A server that has not been seen before takes its first status right away.
+type flapDamper struct {
+        failureThreshold  int
+        recoveryThreshold int
+
+        mu      sync.Mutex
+        servers map[ServerName]*dampedState
+}
+
+func newFlapDamper(failureThreshold, recoveryThreshold int) *flapDamper {
+        return &flapDamper{
+                failureThreshold:  failureThreshold,
+                recoveryThreshold: recoveryThreshold,
+                servers:           make(map[ServerName]*dampedState),
+        }
+}
+
+// restore sets the confirmed status of a server, as saved before a restart
+func (d *flapDamper) restore(server ServerName, confirmed string) {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+        d.servers[server] = &dampedState{Confirmed: confirmed}
+}
+
+// observe counts the status of a new check and returns the confirmed status. suspect is set when the
+// server is confirmed OK, but has failed checks that have not reached the threshold yet.
+func (d *flapDamper) observe(server ServerName, status string) (confirmed string, suspect bool) {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+        state, ok := d.servers[server]
+        if !ok {
+                d.servers[server] = &dampedState{Confirmed: status}
+                return status, false
+        }
+
+        wasOK := isStatusOK(state.Confirmed)
+        switch {
+        case isStatusOK(status) == wasOK:
+                // Same side as before; keep the reason of a failure up to date
+                state.Confirmed, state.Failures, state.Successes = status, 0, 0
+        case wasOK:
+                state.Failures++
+                if state.Failures >= d.failureThreshold {
+                        state.Confirmed, state.Failures = status, 0
+                }
+        default:
+                state.Successes++
+                if state.Successes >= d.recoveryThreshold {
+                        state.Confirmed, state.Successes = status, 0
+                }
+        }
+        return state.Confirmed, isStatusOK(state.Confirmed) && state.Failures > 0
+}
+
+// forget drops the servers that are no longer checked, so they start afresh if they come back
+func (d *flapDamper) forget(checked map[ServerName]CheckResult) {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+        for server := range d.servers {
+                if _, ok := checked[server]; !ok {
+                        delete(d.servers, server)
+                }
+        }
+}
+
+// dampResults fills in the confirmed status of every result of a cycle
+func (m *Monitor) dampResults(results map[ServerName]CheckResult) {
+        for server, result := range results {
+                result.Confirmed, result.Suspect = m.damper.observe(server, result.Status)
+                results[server] = result
+        }
+        m.damper.forget(results)
+}
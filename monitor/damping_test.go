@@ -0,0 +1,84 @@
+package monitor
+
+import "testing"
+
+func TestFlapDamperObserve(t *testing.T) {
+        type step struct {
+                status    string
+                confirmed string
+                suspect   bool
+        }
+        tests := []struct {
+                name              string
+                failure, recovery int
+                steps             []step
+        }{
+                {name: "first status is taken right away", failure: 3, recovery: 3, steps: []step{
+                        {"Offline: timeout", "Offline: timeout", false},
+                }},
+                {name: "down after the failure threshold", failure: 3, recovery: 1, steps: []step{
+                        {"OK", "OK", false},
+                        {"Offline: timeout", "OK", true},
+                        {"Offline: refused", "OK", true},
+                        {"Offline: timeout", "Offline: timeout", false},
+                        {"Offline: refused", "Offline: refused", false}, // Reason kept up to date
+                }},
+                {name: "an OK check resets the failures", failure: 2, recovery: 1, steps: []step{
+                        {"OK", "OK", false},
+                        {"Offline: timeout", "OK", true},
+                        {"OK", "OK", false},
+                        {"Offline: timeout", "OK", true},
+                        {"Offline: timeout", "Offline: timeout", false},
+                }},
+                {name: "up after the recovery threshold", failure: 1, recovery: 2, steps: []step{
+                        {"Offline: timeout", "Offline: timeout", false},
+                        {"OK", "Offline: timeout", false},
+                        {"OK", "OK", false},
+                }},
+                {name: "a failure resets the successes", failure: 1, recovery: 2, steps: []step{
+                        {"Degraded: bad keys", "Degraded: bad keys", false},
+                        {"OK", "Degraded: bad keys", false},
+                        {"Offline: timeout", "Offline: timeout", false},
+                        {"OK", "Offline: timeout", false},
+                        {"OK", "OK", false},
+                }},
+                {name: "thresholds of 1 follow every check", failure: 1, recovery: 1, steps: []step{
+                        {"OK", "OK", false},
+                        {"Offline: timeout", "Offline: timeout", false},
+                        {"OK", "OK", false},
+                }},
+        }
+        for _, tt := range tests {
+                damper := newFlapDamper(tt.failure, tt.recovery)
+                server := ServerName{Host: "example.org"}
+                for i, s := range tt.steps {
+                        confirmed, suspect := damper.observe(server, s.status)
+                        if confirmed != s.confirmed || suspect != s.suspect {
+                                t.Errorf("%s: check %d (%s) gave %q suspect=%v, want %q suspect=%v",
+                                        tt.name, i+1, s.status, confirmed, suspect, s.confirmed, s.suspect)
+                        }
+                }
+        }
+}
+
+func TestFlapDamperRestoreAndForget(t *testing.T) {
+        damper := newFlapDamper(2, 1)
+        kept := ServerName{Host: "kept.example.org"}
+        dropped := ServerName{Host: "dropped.example.org"}
+
+        // A restored status is damped like one that was observed
+        damper.restore(kept, "OK")
+        damper.restore(dropped, "OK")
+        if confirmed, suspect := damper.observe(kept, "Offline: timeout"); confirmed != "OK" || !suspect {
+                t.Errorf("restored server gave %q suspect=%v, want OK suspect=true", confirmed, suspect)
+        }
+
+        damper.forget(map[ServerName]CheckResult{kept: {}})
+        if confirmed, _ := damper.observe(kept, "Offline: timeout"); confirmed != "Offline: timeout" {
+                t.Errorf("kept server lost its failures: got %q", confirmed)
+        }
+        // A forgotten server starts afresh and takes its first status right away
+        if confirmed, suspect := damper.observe(dropped, "Offline: timeout"); confirmed != "Offline: timeout" || suspect {
+                t.Errorf("forgotten server gave %q suspect=%v, want its first status", confirmed, suspect)
+        }
+}
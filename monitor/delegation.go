@@ -0,0 +1,275 @@
+package monitor
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "net"
+        "strings"
+        "time"
+        "unicode/utf8"
+)
+
+// Delegation diagnostics: every step server discovery tried for a server, to explain misconfigurations
+// ==============================================================
+
+const (
+        delegationTimeout     = 30 * time.Second // Time allowed for a whole diagnosis
+        delegationConcurrency = 4                // Diagnoses running at once, from /delegation and !delegation together
+        reportMaxBodyLength   = 1024             // Characters of the .well-known body kept in a report
+)
+
+// ErrDiagnosesBusy is returned by DiagnoseDelegation when too many diagnoses are running already
+var ErrDiagnosesBusy = errors.New("monitor: too many delegation diagnoses in progress, try again later")
+
+// DelegationReport explains how server discovery resolved a server name, or why it failed
+type DelegationReport struct {
+        Server    string           `json:"server"`
+        Time      time.Time        `json:"time"`
+        WellKnown *WellKnownReport `json:"well_known,omitempty"` // Nil when the server name is an IP literal or has a port
+        SRV       []SRVReport      `json:"srv,omitempty"`        // SRV lookups, in the order they were tried
+        Hosts     []HostReport     `json:"hosts,omitempty"`      // Address lookups of the final host
+        Rule      string           `json:"rule,omitempty"`       // Step of the spec algorithm that decided, e.g. "3.3"
+        Reason    string           `json:"reason,omitempty"`     // Why that step was taken
+        Address   string           `json:"address,omitempty"`    // Where federation traffic goes, when discovery succeeded
+        Host      string           `json:"host,omitempty"`       // Host header and TLS name sent there
+        Error     string           `json:"error,omitempty"`
+}
+
+// WellKnownReport is what the request for /.well-known/matrix/server returned
+type WellKnownReport struct {
+        URL         string   `json:"url"`
+        Redirects   []string `json:"redirects,omitempty"`
+        Status      string   `json:"status,omitempty"` // HTTP status, empty when there was no response
+        ContentType string   `json:"content_type,omitempty"`
+        Body        string   `json:"body,omitempty"` // Start of the response body
+        MServer     string   `json:"m_server,omitempty"`
+        HasPort     bool     `json:"has_port"` // Whether m.server names a port, which skips the SRV lookups
+        CacheFor    string   `json:"cache_for,omitempty"`
+        Error       string   `json:"error,omitempty"` // Request, status or parse error that made the response unusable
+}
+
+// SRVReport is one SRV lookup
+type SRVReport struct {
+        Name     string      `json:"name"` // e.g. _matrix-fed._tcp.example.org
+        Records  []SRVRecord `json:"records,omitempty"`
+        Selected string      `json:"selected,omitempty"` // Address picked from the records
+        Error    string      `json:"error,omitempty"`
+}
+
+// SRVRecord is an SRV record with its TTL, which is zero when the Resolver cannot tell it
+type SRVRecord struct {
+        Target   string `json:"target"`
+        Port     uint16 `json:"port"`
+        Priority uint16 `json:"priority"`
+        Weight   uint16 `json:"weight"`
+        TTL      uint32 `json:"ttl,omitempty"` // Seconds
+}
+
+// HostReport is an address lookup of a hostname
+type HostReport struct {
+        Host      string   `json:"host"`
+        Addresses []string `json:"addresses,omitempty"`
+        Error     string   `json:"error,omitempty"`
+}
+
+// SRVTTLResolver is implemented by resolvers that can tell the TTL of SRV records.
+// Delegation reports show TTLs when Options.Resolver implements it, as DNSResolver does.
+type SRVTTLResolver interface {
+        LookupSRVTTL(ctx context.Context, service, proto, name string) ([]SRVRecord, error)
+}
+
+// discoveryTrace collects a DelegationReport while resolveMatrixServer runs. A nil trace records nothing.
+type discoveryTrace struct {
+        report *DelegationReport
+}
+
+func (t *discoveryTrace) rule(rule, reason string) {
+        if t == nil {
+                return
+        }
+        t.report.Rule, t.report.Reason = rule, reason
+}
+
+func (t *discoveryTrace) wellKnown(report *WellKnownReport, server ServerName, cacheFor time.Duration, err error) {
+        if t == nil {
+                return
+        }
+        if err != nil {
+                report.Error = err.Error()
+        } else {
+                report.HasPort = server.Port != 0
+                report.CacheFor = cacheFor.String()
+        }
+        t.report.WellKnown = report
+}
+
+// lookupSRV looks up `_<service>._tcp.<hostname>` for the report, with TTLs if the resolver can tell them
+func (t *discoveryTrace) lookupSRV(ctx context.Context, resolver Resolver, service, hostname string) ([]*net.SRV, error) {
+        report := SRVReport{Name: fmt.Sprintf("_%s._tcp.%s", service, hostname)}
+        var records []*net.SRV
+        var err error
+        if ttlResolver, ok := resolver.(SRVTTLResolver); ok {
+                report.Records, err = ttlResolver.LookupSRVTTL(ctx, service, "tcp", hostname)
+                for _, record := range report.Records {
+                        records = append(records, &net.SRV{Target: record.Target, Port: record.Port, Priority: record.Priority, Weight: record.Weight})
+                }
+        } else {
+                _, records, err = resolver.LookupSRV(ctx, service, "tcp", hostname)
+                for _, srv := range records {
+                        report.Records = append(report.Records, SRVRecord{Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+                }
+        }
+        if err != nil {
+                report.Error = err.Error()
+        }
+        t.report.SRV = append(t.report.SRV, report)
+        return records, err
+}
+
+func (t *discoveryTrace) selectSRV(address string) {
+        if t == nil || len(t.report.SRV) == 0 {
+                return
+        }
+        t.report.SRV[len(t.report.SRV)-1].Selected = address
+}
+
+func (t *discoveryTrace) host(hostname string, addresses []string, err error) {
+        if t == nil {
+                return
+        }
+        report := HostReport{Host: hostname, Addresses: addresses}
+        if err != nil {
+                report.Error = err.Error()
+        }
+        t.report.Hosts = append(t.report.Hosts, report)
+}
+
+// DiagnoseDelegation runs server discovery for a server and reports every step it tried.
+// The .well-known cache of the checks is bypassed, so the report shows the server as it is now.
+// Anyone may ask for a diagnosis, so only a few run at once; beyond that, ErrDiagnosesBusy is returned.
+func (m *Monitor) DiagnoseDelegation(ctx context.Context, server ServerName) (*DelegationReport, error) {
+        if !m.acquireDiagnosis() {
+                return nil, ErrDiagnosesBusy
+        }
+        defer m.releaseDiagnosis()
+        return m.diagnoseDelegation(ctx, server), nil
+}
+
+func (m *Monitor) acquireDiagnosis() bool {
+        select {
+        case m.diagnoses <- struct{}{}:
+                return true
+        default:
+                return false
+        }
+}
+
+func (m *Monitor) releaseDiagnosis() {
+        <-m.diagnoses
+}
+
+// diagnoseDelegation is DiagnoseDelegation without the limit
+func (m *Monitor) diagnoseDelegation(ctx context.Context, server ServerName) *DelegationReport {
+        report, _, _ := m.traceDelegation(ctx, server)
+        return report
+}
+
+// traceDelegation resolves a server and reports every step it tried. The resolved server is returned
+// as well, so that a caller can check the server where the report says it is without resolving it again.
+func (m *Monitor) traceDelegation(ctx context.Context, server ServerName) (*DelegationReport, resolvedServer, error) {
+        ctx, cancel := context.WithTimeout(ctx, delegationTimeout)
+        defer cancel()
+
+        trace := &discoveryTrace{report: &DelegationReport{Server: server.String(), Time: m.opts.Clock.Now()}}
+        resolved, err := m.resolveMatrixServer(ctx, server, trace)
+        if err != nil {
+                trace.report.Error = err.Error()
+        } else {
+                trace.report.Address, trace.report.Host = resolved.Address, resolved.Host
+        }
+        return trace.report, resolved, err
+}
+
+// Format explains the report in plain text, for the log room or a server admin
+func (r *DelegationReport) Format() string {
+        var sb strings.Builder
+        fmt.Fprintf(&sb, "Delegation of %s (%s):\n", r.Server, r.Time.UTC().Format("2006-01-02 15:04 MST"))
+
+        if wk := r.WellKnown; wk != nil {
+                fmt.Fprintf(&sb, "- .well-known: GET %s\n", wk.URL)
+                for _, redirect := range wk.Redirects {
+                        fmt.Fprintf(&sb, "  redirected to %s\n", redirect)
+                }
+                if wk.Status != "" {
+                        fmt.Fprintf(&sb, "  response: %s, Content-Type %q\n", wk.Status, wk.ContentType)
+                }
+                if wk.Body != "" {
+                        fmt.Fprintf(&sb, "  body: %s\n", wk.Body)
+                }
+                if wk.Error != "" {
+                        fmt.Fprintf(&sb, "  not usable: %s\n", wk.Error)
+                } else {
+                        port := "no port, so SRV records of the delegated host are looked up"
+                        if wk.HasPort {
+                                port = "with a port, so SRV records are not looked up"
+                        }
+                        fmt.Fprintf(&sb, "  m.server: %s (%s), cached for %s\n", wk.MServer, port, wk.CacheFor)
+                }
+        }
+
+        for _, srv := range r.SRV {
+                fmt.Fprintf(&sb, "- SRV %s:", srv.Name)
+                switch {
+                case srv.Error != "":
+                        fmt.Fprintf(&sb, " %s\n", srv.Error)
+                case len(srv.Records) == 0:
+                        sb.WriteString(" no records\n")
+                default:
+                        sb.WriteString("\n")
+                }
+                for _, record := range srv.Records {
+                        fmt.Fprintf(&sb, "  %d %d %d %s", record.Priority, record.Weight, record.Port, record.Target)
+                        if record.TTL != 0 {
+                                fmt.Fprintf(&sb, " (TTL %ds)", record.TTL)
+                        }
+                        if record.Target == "." {
+                                sb.WriteString(" (service not available)")
+                        }
+                        sb.WriteString("\n")
+                }
+                if srv.Selected != "" {
+                        fmt.Fprintf(&sb, "  selected %s\n", srv.Selected)
+                }
+        }
+
+        for _, host := range r.Hosts {
+                if host.Error != "" {
+                        fmt.Fprintf(&sb, "- Lookup of %s failed: %s\n", host.Host, host.Error)
+                } else {
+                        fmt.Fprintf(&sb, "- %s resolves to %s\n", host.Host, strings.Join(host.Addresses, ", "))
+                }
+        }
+
+        if r.Rule != "" {
+                fmt.Fprintf(&sb, "Step %s of the spec: %s.\n", r.Rule, r.Reason)
+        }
+        if r.Error != "" {
+                fmt.Fprintf(&sb, "Discovery failed: %s", r.Error)
+        } else {
+                fmt.Fprintf(&sb, "Federation traffic goes to %s with Host and TLS name %s.", r.Address, r.Host)
+        }
+        return sb.String()
+}
+
+// truncateBody returns the start of a response body as text for a report
+func truncateBody(body []byte) string {
+        if !utf8.Valid(body) {
+                return fmt.Sprintf("(%d bytes of binary data)", len(body))
+        }
+        text := strings.TrimSpace(string(body))
+        if utf8.RuneCountInString(text) <= reportMaxBodyLength {
+                return text
+        }
+        return string([]rune(text)[:reportMaxBodyLength]) + "…"
+}
@@ -0,0 +1,102 @@
+package monitor
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "net"
+        "strings"
+        "time"
+
+        "github.com/miekg/dns"
+)
+
+// DNS resolver that can also tell the TTLs of SRV records, for delegation reports
+// ==============================================================
+
+// DNSResolver is the default Resolver. Lookups for checks go through the embedded *net.Resolver;
+// LookupSRVTTL asks the nameservers of the system configuration directly, since net.Resolver
+// does not return TTLs.
+type DNSResolver struct {
+        *net.Resolver
+
+        ResolvConf string        // Path of the resolv.conf listing the nameservers, defaults to /etc/resolv.conf
+        Timeout    time.Duration // Time allowed for each query of LookupSRVTTL, defaults to DefaultProbeTimeout
+}
+
+// NewDNSResolver creates a DNSResolver on top of net.DefaultResolver
+func NewDNSResolver() *DNSResolver {
+        return &DNSResolver{Resolver: net.DefaultResolver}
+}
+
+// LookupSRVTTL looks up `_<service>._<proto>.<name>` and returns the records with their TTLs.
+// A name that does not exist returns a *net.DNSError with IsNotFound set, as net.Resolver does.
+func (r *DNSResolver) LookupSRVTTL(ctx context.Context, service, proto, name string) ([]SRVRecord, error) {
+        path := r.ResolvConf
+        if path == "" {
+                path = "/etc/resolv.conf"
+        }
+        config, err := dns.ClientConfigFromFile(path)
+        if err != nil {
+                return nil, fmt.Errorf("failed to read nameservers: %w", err)
+        }
+        if len(config.Servers) == 0 {
+                return nil, fmt.Errorf("no nameservers in %s", path)
+        }
+
+        qname := dns.Fqdn(fmt.Sprintf("_%s._%s.%s", service, proto, name))
+        query := new(dns.Msg)
+        query.SetQuestion(qname, dns.TypeSRV)
+
+        // Try every nameserver in turn, as the system resolver does
+        timeout := r.Timeout
+        if timeout <= 0 {
+                timeout = DefaultProbeTimeout
+        }
+        var lastErr error
+        for _, server := range config.Servers {
+                resp, err := exchangeDNS(ctx, query, net.JoinHostPort(server, config.Port), timeout)
+                if err != nil {
+                        lastErr = err
+                        continue
+                }
+
+                switch resp.Rcode {
+                case dns.RcodeSuccess:
+                case dns.RcodeNameError:
+                        return nil, &net.DNSError{Err: "no such host", Name: strings.TrimSuffix(qname, "."), Server: server, IsNotFound: true}
+                default:
+                        lastErr = &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: strings.TrimSuffix(qname, "."), Server: server}
+                        continue
+                }
+
+                var records []SRVRecord
+                for _, answer := range resp.Answer {
+                        if srv, ok := answer.(*dns.SRV); ok {
+                                records = append(records, SRVRecord{
+                                        Target:   srv.Target,
+                                        Port:     srv.Port,
+                                        Priority: srv.Priority,
+                                        Weight:   srv.Weight,
+                                        TTL:      srv.Hdr.Ttl,
+                                })
+                        }
+                }
+                return records, nil
+        }
+        if lastErr == nil {
+                lastErr = errors.New("no nameserver answered")
+        }
+        return nil, lastErr
+}
+
+// exchangeDNS sends a query over UDP, and again over TCP if the answer was truncated
+func exchangeDNS(ctx context.Context, query *dns.Msg, server string, timeout time.Duration) (*dns.Msg, error) {
+        client := &dns.Client{Timeout: timeout}
+        resp, _, err := client.ExchangeContext(ctx, query, server)
+        if err == nil && resp.Truncated {
+                client.Net = "tcp"
+                resp, _, err = client.ExchangeContext(ctx, query, server)
+        }
+        return resp, err
+}
@@ -0,0 +1,82 @@
+package monitor
+
+import (
+        "context"
+        "fmt"
+        "strings"
+        "time"
+)
+
+// Single server reports: server discovery and every probe for one server, for debugging from a shell
+// ==============================================================
+
+// ServerReport is everything a check of one server found out
+type ServerReport struct {
+        Server     string            `json:"server"`
+        Delegation *DelegationReport `json:"delegation"` // How the server name was resolved, step by step
+        Check      CheckRecord       `json:"check"`      // Version probe, TLS and signing keys
+        Advisories []*Advisory       `json:"advisories,omitempty"`
+}
+
+// InspectServer diagnoses the delegation of a server, then checks it the way a check cycle does,
+// without retries. Discovery runs once, so the check goes where the delegation report says.
+// It needs no Matrix client.
+func (m *Monitor) InspectServer(ctx context.Context, server ServerName) *ServerReport {
+        result := CheckResult{Server: server, Time: m.opts.Clock.Now()}
+        start := time.Now()
+        delegation, matrixServer, err := m.traceDelegation(ctx, server)
+        report := &ServerReport{
+                Server:     server.String(),
+                Delegation: delegation,
+        }
+        result = m.checkResolvedServer(ctx, result, start, matrixServer, err)
+        report.Check = newCheckRecord(result)
+        report.Advisories = m.matchAdvisories(result.Software)
+        return report
+}
+
+// Format explains the report in plain text
+func (r *ServerReport) Format() string {
+        var sb strings.Builder
+        sb.WriteString(r.Delegation.Format())
+        sb.WriteString("\n\n")
+
+        check := r.Check
+        fmt.Fprintf(&sb, "Check of %s: %s in %d ms\n", r.Server, check.Status, check.LatencyMS)
+        if check.Code != "" && check.Code != CodeOK {
+                fmt.Fprintf(&sb, "- Failed at step %q with code %s (%s)\n", check.Step, check.Code, check.Category)
+        }
+        if check.Timings != nil {
+                phases := check.Timings.Phases()
+                sb.WriteString("- Timings:")
+                for _, name := range []string{"delegation", "dns", "connect", "tls", "first_byte", "total"} {
+                        fmt.Fprintf(&sb, " %s %s", name, phases[name].Round(time.Millisecond))
+                }
+                sb.WriteString("\n")
+        }
+
+        if tlsInfo := check.TLS; tlsInfo != nil {
+                fmt.Fprintf(&sb, "- %s for %s\n", tlsInfo.Version, tlsInfo.ServerName)
+                for i, cert := range tlsInfo.Chain {
+                        fmt.Fprintf(&sb, "  %d: %s, issued by %s, valid until %s\n", i, cert.Subject, cert.Issuer, cert.NotAfter.UTC().Format("2006-01-02 15:04 MST"))
+                }
+                if tlsInfo.VerifyError != "" {
+                        fmt.Fprintf(&sb, "  rejected: %s\n", tlsInfo.VerifyError)
+                }
+        }
+
+        if check.Keys != nil {
+                fmt.Fprintf(&sb, "- Signing keys: %s\n", check.Keys)
+        }
+        if check.Software != nil {
+                fmt.Fprintf(&sb, "- Software: %s\n", check.Software)
+        }
+        for _, advisory := range r.Advisories {
+                fmt.Fprintf(&sb, "- Advisory [%s] %s: %s", advisory.Severity, advisory.ID, advisory.Description)
+                if advisory.URL != "" {
+                        fmt.Fprintf(&sb, " (%s)", advisory.URL)
+                }
+                sb.WriteString("\n")
+        }
+        return strings.TrimSuffix(sb.String(), "\n")
+}
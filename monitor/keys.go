@@ -0,0 +1,236 @@
+package monitor
+
+import (
+        "bytes"
+        "context"
+        "crypto/ed25519"
+        "encoding/base64"
+        "encoding/json"
+        "fmt"
+        "io"
+        "net/http"
+        "net/http/httptrace"
+        "sort"
+        "strings"
+        "time"
+)
+
+// Signing key check: the server's published keys must be valid and must sign the key response
+// ==============================================================
+
+const keysMaxBodySize = 64 * 1024
+
+// serverKeys is the response of /_matrix/key/v2/server
+type serverKeys struct {
+        ServerName   string `json:"server_name"`
+        ValidUntilTS int64  `json:"valid_until_ts"`
+        VerifyKeys   map[string]struct {
+                Key string `json:"key"`
+        } `json:"verify_keys"`
+        Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// checkSigningKeys fetches the signing keys of a server and checks that they are published under
+// the right server name, have not expired and sign the response they are published in
+func (m *Monitor) checkSigningKeys(ctx context.Context, server resolvedServer, name ServerName) ProbeStatus {
+        url := fmt.Sprintf("https://%s/_matrix/key/v2/server", server.Host)
+        transport, _ := m.probeTransport(server)
+        client := &http.Client{
+                Timeout:   m.opts.ProbeTimeout,
+                Transport: transport,
+        }
+
+        // Attribute connection failures to the step they happened in, as for the version probe
+        progress := newProbeProgress()
+        req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, progress.trace()), http.MethodGet, url, nil)
+        if err != nil {
+                return classifyError(StepKeys, err)
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+                return classifyError(progress.Step(), err)
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode != http.StatusOK {
+                return failedStatus(CategoryKeys, CodeKeysUnavailable, StepKeys, resp.Status)
+        }
+        body, err := io.ReadAll(io.LimitReader(resp.Body, keysMaxBodySize))
+        if err != nil {
+                return classifyError(StepKeys, err)
+        }
+        return verifyServerKeys(body, name, m.opts.Clock.Now())
+}
+
+// verifyServerKeys checks a /_matrix/key/v2/server response body for the server name
+func verifyServerKeys(body []byte, name ServerName, now time.Time) ProbeStatus {
+        var keys serverKeys
+        if err := json.Unmarshal(body, &keys); err != nil {
+                return failedStatus(CategoryKeys, CodeKeysInvalid, StepKeys, err.Error())
+        }
+
+        if keys.ServerName != name.String() {
+                return failedStatus(CategoryKeys, CodeKeysWrongServer, StepKeys,
+                        fmt.Sprintf("keys are published for %q instead of %q", keys.ServerName, name))
+        }
+
+        validUntil := time.UnixMilli(keys.ValidUntilTS)
+        if !validUntil.After(now) {
+                return failedStatus(CategoryKeys, CodeKeysExpired, StepKeys,
+                        fmt.Sprintf("valid_until_ts %s is in the past", validUntil.UTC().Format(time.RFC3339)))
+        }
+
+        // The signatures cover the canonical JSON of the response without signatures and unsigned
+        var object map[string]json.RawMessage
+        if err := json.Unmarshal(body, &object); err != nil {
+                return failedStatus(CategoryKeys, CodeKeysInvalid, StepKeys, err.Error())
+        }
+        delete(object, "signatures")
+        delete(object, "unsigned")
+        unsigned, err := json.Marshal(object)
+        if err != nil {
+                return failedStatus(CategoryKeys, CodeKeysInvalid, StepKeys, err.Error())
+        }
+        signed, err := canonicalJSON(unsigned)
+        if err != nil {
+                return failedStatus(CategoryKeys, CodeKeysInvalid, StepKeys, err.Error())
+        }
+
+        // Every ed25519 key the server publishes must be well-formed, and at least one of them must have
+        // signed the response: a server may publish a new key before it signs with it
+        keyIDs := make([]string, 0, len(keys.VerifyKeys))
+        for keyID := range keys.VerifyKeys {
+                if strings.HasPrefix(keyID, "ed25519:") {
+                        keyIDs = append(keyIDs, keyID)
+                }
+        }
+        if len(keyIDs) == 0 {
+                return failedStatus(CategoryKeys, CodeKeysInvalid, StepKeys, "no ed25519 verify_keys")
+        }
+        sort.Strings(keyIDs)
+
+        publicKeys := make(map[string]ed25519.PublicKey, len(keyIDs))
+        for _, keyID := range keyIDs {
+                publicKey, err := decodeBase64(keys.VerifyKeys[keyID].Key)
+                if err != nil || len(publicKey) != ed25519.PublicKeySize {
+                        return failedStatus(CategoryKeys, CodeKeysInvalid, StepKeys, fmt.Sprintf("invalid key %s", keyID))
+                }
+                publicKeys[keyID] = ed25519.PublicKey(publicKey)
+        }
+
+        var problems []string
+        for _, keyID := range keyIDs {
+                signature, ok := keys.Signatures[keys.ServerName][keyID]
+                if !ok {
+                        problems = append(problems, fmt.Sprintf("no signature by %s", keyID))
+                        continue
+                }
+                sig, err := decodeBase64(signature)
+                if err != nil || !ed25519.Verify(publicKeys[keyID], signed, sig) {
+                        problems = append(problems, fmt.Sprintf("signature by %s does not verify", keyID))
+                        continue
+                }
+                return statusOK
+        }
+        return failedStatus(CategoryKeys, CodeKeysBadSignature, StepKeys, strings.Join(problems, ", "))
+}
+
+// decodeBase64 decodes the unpadded base64 used by Matrix, accepting padding as well
+func decodeBase64(s string) ([]byte, error) {
+        return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// canonicalJSON re-encodes a JSON value as Matrix canonical JSON: object keys sorted by code point,
+// no insignificant whitespace, and strings escaped only where JSON requires it
+func canonicalJSON(data []byte) ([]byte, error) {
+        decoder := json.NewDecoder(bytes.NewReader(data))
+        decoder.UseNumber()
+        var value interface{}
+        if err := decoder.Decode(&value); err != nil {
+                return nil, err
+        }
+        var buf bytes.Buffer
+        if err := writeCanonical(&buf, value); err != nil {
+                return nil, err
+        }
+        return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, value interface{}) error {
+        switch v := value.(type) {
+        case nil:
+                buf.WriteString("null")
+        case bool:
+                if v {
+                        buf.WriteString("true")
+                } else {
+                        buf.WriteString("false")
+                }
+        case json.Number:
+                if strings.ContainsAny(v.String(), ".eE") {
+                        return fmt.Errorf("canonical JSON does not allow the number %s", v)
+                }
+                buf.WriteString(v.String())
+        case string:
+                writeCanonicalString(buf, v)
+        case []interface{}:
+                buf.WriteByte('[')
+                for i, item := range v {
+                        if i > 0 {
+                                buf.WriteByte(',')
+                        }
+                        if err := writeCanonical(buf, item); err != nil {
+                                return err
+                        }
+                }
+                buf.WriteByte(']')
+        case map[string]interface{}:
+                keys := make([]string, 0, len(v))
+                for key := range v {
+                        keys = append(keys, key)
+                }
+                sort.Strings(keys) // Byte order of UTF-8 is code point order
+                buf.WriteByte('{')
+                for i, key := range keys {
+                        if i > 0 {
+                                buf.WriteByte(',')
+                        }
+                        writeCanonicalString(buf, key)
+                        buf.WriteByte(':')
+                        if err := writeCanonical(buf, v[key]); err != nil {
+                                return err
+                        }
+                }
+                buf.WriteByte('}')
+        default:
+                return fmt.Errorf("unexpected JSON value %T", value)
+        }
+        return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+        buf.WriteByte('"')
+        for _, r := range s {
+                switch {
+                case r == '"':
+                        buf.WriteString(`\"`)
+                case r == '\\':
+                        buf.WriteString(`\\`)
+                case r == '\b':
+                        buf.WriteString(`\b`)
+                case r == '\f':
+                        buf.WriteString(`\f`)
+                case r == '\n':
+                        buf.WriteString(`\n`)
+                case r == '\r':
+                        buf.WriteString(`\r`)
+                case r == '\t':
+                        buf.WriteString(`\t`)
+                case r < 0x20:
+                        fmt.Fprintf(buf, `\u%04x`, r)
+                default:
+                        buf.WriteRune(r)
+                }
+        }
+        buf.WriteByte('"')
+}
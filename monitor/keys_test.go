@@ -0,0 +1,188 @@
+package monitor
+
+import (
+        "crypto/ed25519"
+        "encoding/base64"
+        "encoding/json"
+        "testing"
+        "time"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+        tests := []struct {
+                in   string
+                want string
+        }{
+                // Examples of the Matrix appendix on canonical JSON
+                {`{}`, `{}`},
+                {`{"one": 1, "two": "Two"}`, `{"one":1,"two":"Two"}`},
+                {`{"b": "2", "a": "1"}`, `{"a":"1","b":"2"}`},
+                {`{"auth": {"success": true, "mxid": "@john.doe:example.com", "profile": {"display_name": "John Doe",
+                        "three_pids": [{"medium": "email", "address": "john.doe@example.org"},
+                        {"medium": "msisdn", "address": "123456789"}]}}}`,
+                        `{"auth":{"mxid":"@john.doe:example.com","profile":{"display_name":"John Doe","three_pids":` +
+                                `[{"address":"john.doe@example.org","medium":"email"},{"address":"123456789","medium":"msisdn"}]},"success":true}}`},
+                {`{"a": "日本語"}`, `{"a":"日本語"}`},
+                {`{"本": 2, "日": 1}`, `{"日":1,"本":2}`},
+                {`{"a": "日"}`, `{"a":"日"}`},
+                {`{"a": null}`, `{"a":null}`},
+
+                // Escapes: only what JSON requires, with the short forms where there are some
+                {`{"a": "\/ é \u0001 \u001F"}`, `{"a":"/ é \u0001 \u001f"}`},
+                {`{"a": "\"\\\b\f\n\r\t"}`, `{"a":"\"\\\b\f\n\r\t"}`},
+                {`[3, 1, 2, -7, 9007199254740991]`, `[3,1,2,-7,9007199254740991]`},
+        }
+        for _, tt := range tests {
+                got, err := canonicalJSON([]byte(tt.in))
+                if err != nil {
+                        t.Errorf("canonicalJSON(%s) failed: %v", tt.in, err)
+                        continue
+                }
+                if string(got) != tt.want {
+                        t.Errorf("canonicalJSON(%s) = %s, want %s", tt.in, got, tt.want)
+                }
+        }
+
+        for _, in := range []string{`{"a": 1.5}`, `{"a": 1e10}`, `{"a": `, `not json`} {
+                if got, err := canonicalJSON([]byte(in)); err == nil {
+                        t.Errorf("canonicalJSON(%s) = %s, want an error", in, got)
+                }
+        }
+}
+
+// signedKeys builds a key response for example.org, signed by key unless sign is false
+func signedKeys(t *testing.T, key ed25519.PrivateKey, response map[string]interface{}, sign bool) map[string]interface{} {
+        t.Helper()
+        unsigned, err := json.Marshal(response)
+        if err != nil {
+                t.Fatal(err)
+        }
+        canonical, err := canonicalJSON(unsigned)
+        if err != nil {
+                t.Fatal(err)
+        }
+        signed := make(map[string]interface{}, len(response)+1)
+        for k, v := range response {
+                signed[k] = v
+        }
+        if sign {
+                signed["signatures"] = map[string]map[string]string{
+                        "example.org": {"ed25519:a_key": base64.RawStdEncoding.EncodeToString(ed25519.Sign(key, canonical))},
+                }
+        }
+        return signed
+}
+
+func TestVerifyServerKeys(t *testing.T) {
+        publicKey, privateKey, err := ed25519.GenerateKey(nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        otherPublicKey, otherKey, err := ed25519.GenerateKey(nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+        name, _ := ParseServerName("example.org")
+
+        response := func(fields map[string]interface{}) map[string]interface{} {
+                r := map[string]interface{}{
+                        "server_name":    "example.org",
+                        "valid_until_ts": now.Add(time.Hour).UnixMilli(),
+                        "verify_keys": map[string]interface{}{
+                                "ed25519:a_key": map[string]string{"key": base64.RawStdEncoding.EncodeToString(publicKey)},
+                        },
+                        "old_verify_keys": map[string]interface{}{},
+                }
+                for k, v := range fields {
+                        r[k] = v
+                }
+                return r
+        }
+
+        tests := []struct {
+                name string
+                body func() map[string]interface{}
+                raw  string // Body used as is instead of body
+                want string // Expected code
+        }{
+                {name: "valid", want: CodeOK, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(nil), true)
+                }},
+                {name: "unsigned members are not signed", want: CodeOK, body: func() map[string]interface{} {
+                        keys := signedKeys(t, privateKey, response(nil), true)
+                        keys["unsigned"] = map[string]string{"note": "added later"}
+                        return keys
+                }},
+                {name: "padded base64", want: CodeOK, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{
+                                "verify_keys": map[string]interface{}{
+                                        "ed25519:a_key": map[string]string{"key": base64.StdEncoding.EncodeToString(publicKey)},
+                                },
+                        }), true)
+                }},
+                {name: "signed by one of two keys", want: CodeOK, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{
+                                "verify_keys": map[string]interface{}{
+                                        "ed25519:a_key": map[string]string{"key": base64.RawStdEncoding.EncodeToString(publicKey)},
+                                        "ed25519:b_key": map[string]string{"key": base64.RawStdEncoding.EncodeToString(otherPublicKey)},
+                                },
+                        }), true)
+                }},
+                {name: "wrong server name", want: CodeKeysWrongServer, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{"server_name": "other.org"}), true)
+                }},
+                {name: "expired", want: CodeKeysExpired, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{"valid_until_ts": now.Add(-time.Hour).UnixMilli()}), true)
+                }},
+                {name: "not signed", want: CodeKeysBadSignature, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(nil), false)
+                }},
+                {name: "signed by another key", want: CodeKeysBadSignature, body: func() map[string]interface{} {
+                        return signedKeys(t, otherKey, response(nil), true)
+                }},
+                {name: "signed by none of two keys", want: CodeKeysBadSignature, body: func() map[string]interface{} {
+                        return signedKeys(t, otherKey, response(map[string]interface{}{
+                                "verify_keys": map[string]interface{}{
+                                        "ed25519:a_key": map[string]string{"key": base64.RawStdEncoding.EncodeToString(publicKey)},
+                                        "ed25519:b_key": map[string]string{"key": base64.RawStdEncoding.EncodeToString(otherPublicKey)},
+                                },
+                        }), true)
+                }},
+                {name: "changed after signing", want: CodeKeysBadSignature, body: func() map[string]interface{} {
+                        keys := signedKeys(t, privateKey, response(nil), true)
+                        keys["old_verify_keys"] = map[string]interface{}{"ed25519:old": map[string]interface{}{"key": "AAAA", "expired_ts": 1}}
+                        return keys
+                }},
+                {name: "no ed25519 key", want: CodeKeysInvalid, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{"verify_keys": map[string]interface{}{}}), true)
+                }},
+                {name: "invalid key", want: CodeKeysInvalid, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{
+                                "verify_keys": map[string]interface{}{"ed25519:a_key": map[string]string{"key": "not base64!"}},
+                        }), true)
+                }},
+                {name: "invalid key next to a signing one", want: CodeKeysInvalid, body: func() map[string]interface{} {
+                        return signedKeys(t, privateKey, response(map[string]interface{}{
+                                "verify_keys": map[string]interface{}{
+                                        "ed25519:a_key": map[string]string{"key": base64.RawStdEncoding.EncodeToString(publicKey)},
+                                        "ed25519:b_key": map[string]string{"key": "AAAA"},
+                                },
+                        }), true)
+                }},
+                {name: "not JSON", want: CodeKeysInvalid, raw: "<html>"},
+                {name: "float in the response", want: CodeKeysInvalid, raw: `{"server_name": "example.org", "valid_until_ts": 1e15}`},
+        }
+        for _, tt := range tests {
+                body := []byte(tt.raw)
+                if tt.body != nil {
+                        if body, err = json.Marshal(tt.body()); err != nil {
+                                t.Fatal(err)
+                        }
+                }
+                got := verifyServerKeys(body, name, now)
+                if got.Code != tt.want {
+                        t.Errorf("%s: got %s (%s), want %s", tt.name, got.Code, got.Detail, tt.want)
+                }
+        }
+}
@@ -0,0 +1,192 @@
+package monitor
+
+import (
+        "errors"
+        "fmt"
+        "sync"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "maunium.net/go/mautrix"
+)
+
+// Prometheus metrics, registered with Options.Registerer
+// ==============================================================
+
+// metrics holds the Prometheus metrics of a Monitor
+type metrics struct {
+        serverUp      *prometheus.GaugeVec
+        serverSuspect *prometheus.GaugeVec
+        probeLatency  *prometheus.GaugeVec
+        probePhase    *prometheus.GaugeVec
+        lastChange    *prometheus.GaugeVec
+        certExpiry    *prometheus.GaugeVec
+        keysValid     *prometheus.GaugeVec
+        serverInfo    *prometheus.GaugeVec
+        roomUsers     *prometheus.GaugeVec
+        failures      *prometheus.CounterVec
+        cycleDuration prometheus.Histogram
+        rooms         prometheus.Gauge
+        apiErrors     *prometheus.CounterVec
+
+        knownServers sync.Map // Servers that already have a last change timestamp in this process
+}
+
+// newMetrics creates the metrics and registers them with reg. If any of them is already registered,
+// as when a second Monitor shares the registry, the others are unregistered again and the error of
+// the registry, a prometheus.AlreadyRegisteredError, is returned.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+        mx := &metrics{
+                serverUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_up",
+                        Help: "Whether the server is confirmed up (1) or down (0), after flap damping.",
+                }, []string{"server"}),
+
+                serverSuspect: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_suspect",
+                        Help: "Whether the server is still confirmed up, but failed its last checks (1), or not (0).",
+                }, []string{"server"}),
+
+                probeLatency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_probe_latency_seconds",
+                        Help: "Time taken by server discovery and the federation probe in the last cycle.",
+                }, []string{"server"}),
+
+                probePhase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_probe_phase_seconds",
+                        Help: "Time taken by each phase of the last check: delegation, dns, connect, tls, first_byte and total.",
+                }, []string{"server", "phase"}),
+
+                lastChange: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_last_change_timestamp_seconds",
+                        Help: "Unix time at which the server status last changed, or was first seen by this process.",
+                }, []string{"server"}),
+
+                certExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_cert_expiry_timestamp_seconds",
+                        Help: "Unix time at which the certificate the server presented in the last cycle expires.",
+                }, []string{"server"}),
+
+                keysValid: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_keys_valid",
+                        Help: "Whether the signing keys of the server verified in the last cycle (1) or not (0). Missing when the version check failed.",
+                }, []string{"server"}),
+
+                serverInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_server_info",
+                        Help: "Software and version the server reported in the last cycle; always 1.",
+                }, []string{"server", "software", "version"}),
+
+                roomUsers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "matrix_health_room_server_users",
+                        Help: "Number of joined users from the server in the room.",
+                }, []string{"room_id", "server"}),
+
+                failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "matrix_health_server_failures_total",
+                        Help: "Number of failed server checks, by error code.",
+                }, []string{"server", "code"}),
+
+                cycleDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+                        Name:    "matrix_health_cycle_duration_seconds",
+                        Help:    "Duration of a full check cycle.",
+                        Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+                }),
+
+                rooms: prometheus.NewGauge(prometheus.GaugeOpts{
+                        Name: "matrix_health_rooms",
+                        Help: "Number of rooms checked in the last cycle.",
+                }),
+
+                apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "matrix_health_client_api_errors_total",
+                        Help: "Number of failed client API calls to our homeserver, by Matrix error code.",
+                }, []string{"errcode"}),
+        }
+
+        collectors := []prometheus.Collector{
+                mx.serverUp, mx.serverSuspect, mx.probeLatency, mx.probePhase, mx.lastChange, mx.certExpiry, mx.keysValid,
+                mx.serverInfo, mx.roomUsers, mx.failures, mx.cycleDuration, mx.rooms, mx.apiErrors,
+        }
+        for i, collector := range collectors {
+                if err := reg.Register(collector); err != nil {
+                        for _, registered := range collectors[:i] {
+                                reg.Unregister(registered)
+                        }
+                        return nil, fmt.Errorf("monitor: failed to register metrics: %w", err)
+                }
+        }
+        return mx, nil
+}
+
+// recordCycleMetrics updates the per-server and per-room gauges after a check cycle
+func (mx *metrics) recordCycleMetrics(results map[ServerName]CheckResult, roomServers []roomServer, duration time.Duration) {
+        mx.serverUp.Reset()
+        mx.serverSuspect.Reset()
+        mx.probeLatency.Reset()
+        mx.probePhase.Reset()
+        mx.certExpiry.Reset()
+        mx.keysValid.Reset()
+        mx.serverInfo.Reset()
+        for server, result := range results {
+                name := server.String()
+                up, suspect := 0.0, 0.0
+                if isStatusOK(result.Confirmed) {
+                        up = 1
+                }
+                if result.Suspect {
+                        suspect = 1
+                }
+                if !result.Check.OK() {
+                        mx.failures.WithLabelValues(name, result.Check.Code).Inc()
+                }
+                mx.serverUp.WithLabelValues(name).Set(up)
+                mx.serverSuspect.WithLabelValues(name).Set(suspect)
+                mx.probeLatency.WithLabelValues(name).Set(result.Latency.Seconds())
+                for phase, duration := range result.Timings.Phases() {
+                        mx.probePhase.WithLabelValues(name, phase).Set(duration.Seconds())
+                }
+                if result.Keys != nil {
+                        valid := 0.0
+                        if result.Keys.OK() {
+                                valid = 1
+                        }
+                        mx.keysValid.WithLabelValues(name).Set(valid)
+                }
+                if result.Software != nil {
+                        mx.serverInfo.WithLabelValues(name, result.Software.Name, result.Software.Version).Set(1)
+                }
+                if leaf := result.TLS.Leaf(); leaf != nil {
+                        mx.certExpiry.WithLabelValues(name).Set(float64(leaf.NotAfter.Unix()))
+                }
+        }
+
+        mx.roomUsers.Reset()
+        rooms := make(map[string]bool)
+        for _, rs := range roomServers {
+                rooms[rs.RoomID] = true
+                mx.roomUsers.WithLabelValues(rs.RoomID, rs.Server.String()).Set(float64(rs.UserCount))
+        }
+        mx.rooms.Set(float64(len(rooms)))
+
+        mx.cycleDuration.Observe(duration.Seconds())
+}
+
+// recordStatusChange sets the last change timestamp of a server when its status changed,
+// or when this process has not exported one for it yet
+func (mx *metrics) recordStatusChange(server ServerName, changed bool) {
+        _, known := mx.knownServers.LoadOrStore(server, true)
+        if changed || !known {
+                mx.lastChange.WithLabelValues(server.String()).SetToCurrentTime()
+        }
+}
+
+// recordAPIError counts a failed client API call
+func (mx *metrics) recordAPIError(err error) {
+        errcode := "unknown"
+        var httpErr mautrix.HTTPError
+        if errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.RespError.ErrCode != "" {
+                errcode = httpErr.RespError.ErrCode
+        }
+        mx.apiErrors.WithLabelValues(errcode).Inc()
+}
@@ -0,0 +1,376 @@
+// Package monitor checks the federation health of every server that has members in the
+// Matrix rooms a bot account is in, and keeps a tree of rooms and servers with the results.
+//
+// A Monitor is created with New from an Options struct. Everything it talks to, the Matrix
+// client, DNS, HTTP, the clock and the history store, can be replaced, so it can be embedded
+// in other bots and tested without a network.
+package monitor
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "net"
+        "net/http"
+        "os"
+        "sync"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/event"
+        "maunium.net/go/mautrix/id"
+)
+
+// Defaults for optional settings
+const (
+        DefaultInterval         = 6 * time.Minute
+        DefaultAPIConcurrency   = 4
+        DefaultProbeConcurrency = 16
+        DefaultProbeTimeout     = 5 * time.Second
+)
+
+// MatrixClient is the part of the client API the monitor uses. NewMatrixClient adapts a *mautrix.Client.
+type MatrixClient interface {
+        JoinedMembers(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinedMembers, error)
+        StateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error
+        GetProfile(ctx context.Context, userID id.UserID) (*mautrix.RespUserProfile, error)
+        SendText(ctx context.Context, roomID id.RoomID, text string) (*mautrix.RespSendEvent, error)
+
+        // MediaURL returns the HTTP download URL of an mxc:// URI
+        MediaURL(uri id.ContentURI) string
+
+        // Sync runs /sync with the given syncer until ctx is cancelled or syncing fails
+        Sync(ctx context.Context, syncer mautrix.Syncer) error
+}
+
+// Resolver looks up the DNS records used by server discovery. *net.Resolver implements it.
+type Resolver interface {
+        LookupHost(ctx context.Context, host string) ([]string, error)
+        LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Clock tells the time and waits. Elapsed times of probes are always measured with the real clock.
+type Clock interface {
+        Now() time.Time
+        After(d time.Duration) <-chan time.Time
+}
+
+// Store persists check results and the tree between runs. *BoltStore implements it.
+type Store interface {
+        RecordChecks(results []CheckResult) error
+        LatestChecks() (map[string]CheckRecord, error)
+        SaveTree(rooms map[string]*TreeNode) error
+        LoadTree() (map[string]*TreeNode, error)
+
+        // History used to rebuild the uptime figures on startup
+        RecordRoomSamples(samples []RoomSample) error
+        ChecksSince(since time.Time, fn func(CheckRecord) error) error
+        RoomSamplesSince(since time.Time, fn func(RoomSample) error) error
+}
+
+var errMissingClient = errors.New("monitor: a Matrix client is required")
+
+// Options configures a Monitor. Only Client is required, and only by Start and RunOnce:
+// without it, a Monitor can still check single servers.
+type Options struct {
+        Client MatrixClient
+
+        // Room that gets a message when a server goes down or comes back. It is not checked itself.
+        // Empty disables the messages, and so does Silent, for one-shot runs that should not post anything.
+        LogRoom id.RoomID
+        Silent  bool
+
+        // Rooms whose servers are checked. Empty checks every joined room.
+        Rooms []id.RoomID
+
+        Interval         time.Duration // Time between check cycles
+        APIConcurrency   int           // Concurrent client API calls to our homeserver
+        ProbeConcurrency int           // Concurrent federation probes
+        ProbeTimeout     time.Duration // Time allowed for server discovery, and for each probe request, connection included
+
+        // Flap damping: a server is marked down after FailureThreshold failed cycles in a row, and up again
+        // after RecoveryThreshold OK cycles in a row. Within a cycle, transient failures are retried
+        // ProbeRetries times, waiting RetryBackoff before the first retry and twice as long before each
+        // further one. Unlike the other settings, a zero ProbeRetries is kept: it disables retries.
+        FailureThreshold  int
+        RecoveryThreshold int
+        ProbeRetries      int
+        RetryBackoff      time.Duration
+
+        // How long before a certificate expires the log room is warned about it
+        CertExpiryWarning time.Duration
+
+        // Known problems of homeserver versions, flagged on the servers running them. With ReportAdvisories,
+        // the log room is told about servers that newly match an advisory.
+        Advisories       []*Advisory
+        ReportAdvisories bool
+
+        // How long a room the bot left, or a server without members, stays in the tree marked as departed.
+        // Zero removes them right away.
+        DepartedGrace time.Duration
+
+        Resolver   Resolver              // Defaults to a DNSResolver on net.DefaultResolver
+        Transport  *http.Transport       // Template for probe and .well-known requests; defaults to http.DefaultTransport
+        Clock      Clock                 // Defaults to the system clock
+        Store      Store                 // Nil keeps nothing between runs
+        Registerer prometheus.Registerer // Where the metrics are registered; defaults to prometheus.DefaultRegisterer, see New
+        Logger     io.Writer             // Progress and error messages; defaults to os.Stdout
+
+        // Called with the results of every completed check cycle
+        OnResults func(results []CheckResult)
+}
+
+// Monitor tracks the rooms of a Matrix account and periodically checks the servers in them
+type Monitor struct {
+        opts Options
+
+        tree       *treeStore
+        membership *roomMembership
+        apiLimit   *apiLimiter
+        metrics    *metrics
+        uptime     *uptimeTracker
+        damper     *flapDamper
+
+        statuses     sync.Map // Last reported status per ServerName, used to detect changes
+        certWarnings sync.Map // Expiry time of the certificate last warned about, per ServerName
+        software     sync.Map // Last *ServerSoftware reported, per ServerName
+
+        advisoryReports sync.Map // IDs of the advisories last reported, per ServerName
+
+        wellKnownMu    sync.Mutex
+        wellKnownCache map[string]*wellKnownEntry
+
+        diagnoses chan struct{} // One slot per delegation diagnosis in progress
+
+        resultsMu sync.Mutex
+        results   map[ServerName]CheckResult // Results of the last completed cycle
+
+        mu     sync.Mutex
+        cancel context.CancelFunc
+        done   chan struct{} // Closed once the loops started by Start have returned
+}
+
+// New creates a Monitor, filling in defaults for the options that are not set.
+// Each Monitor registers its own metrics, so Monitors that run side by side need a Registerer
+// each; on a shared one, New returns an error wrapping a prometheus.AlreadyRegisteredError.
+func New(opts Options) (*Monitor, error) {
+        if opts.Interval <= 0 {
+                opts.Interval = DefaultInterval
+        }
+        if opts.APIConcurrency <= 0 {
+                opts.APIConcurrency = DefaultAPIConcurrency
+        }
+        if opts.ProbeConcurrency <= 0 {
+                opts.ProbeConcurrency = DefaultProbeConcurrency
+        }
+        if opts.ProbeTimeout <= 0 {
+                opts.ProbeTimeout = DefaultProbeTimeout
+        }
+        if opts.FailureThreshold <= 0 {
+                opts.FailureThreshold = DefaultFailureThreshold
+        }
+        if opts.RecoveryThreshold <= 0 {
+                opts.RecoveryThreshold = DefaultRecoveryThreshold
+        }
+        if opts.RetryBackoff <= 0 {
+                opts.RetryBackoff = DefaultRetryBackoff
+        }
+        if opts.CertExpiryWarning <= 0 {
+                opts.CertExpiryWarning = DefaultCertExpiryWarning
+        }
+        if opts.Resolver == nil {
+                resolver := NewDNSResolver()
+                resolver.Timeout = opts.ProbeTimeout
+                opts.Resolver = resolver
+        }
+        if opts.Transport == nil {
+                opts.Transport = http.DefaultTransport.(*http.Transport)
+        }
+        if opts.Clock == nil {
+                opts.Clock = systemClock{}
+        }
+        if opts.Registerer == nil {
+                opts.Registerer = prometheus.DefaultRegisterer
+        }
+        if opts.Logger == nil {
+                opts.Logger = os.Stdout
+        }
+
+        mx, err := newMetrics(opts.Registerer)
+        if err != nil {
+                return nil, err
+        }
+
+        m := &Monitor{
+                opts:           opts,
+                tree:           newTreeStore(),
+                membership:     newRoomMembership(opts.Logger),
+                metrics:        mx,
+                uptime:         newUptimeTracker(),
+                damper:         newFlapDamper(opts.FailureThreshold, opts.RecoveryThreshold),
+                wellKnownCache: make(map[string]*wellKnownEntry),
+                diagnoses:      make(chan struct{}, delegationConcurrency),
+                results:        make(map[ServerName]CheckResult),
+        }
+        m.apiLimit = newAPILimiter(opts.APIConcurrency, opts.Clock, m.metrics.recordAPIError, opts.Logger)
+        return m, nil
+}
+
+// Start restores the saved state and starts the sync and check loops.
+// They run until Stop is called or ctx is cancelled.
+func (m *Monitor) Start(ctx context.Context) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        if m.cancel != nil {
+                return errors.New("monitor: already started")
+        }
+        if m.opts.Client == nil {
+                return errMissingClient
+        }
+
+        if m.opts.Store != nil {
+                if err := m.restoreState(); err != nil {
+                        fmt.Fprintln(m.opts.Logger, "Failed to restore state from history:", err)
+                }
+        }
+
+        ctx, m.cancel = context.WithCancel(ctx)
+        m.done = make(chan struct{})
+
+        var loops sync.WaitGroup
+        loops.Add(2)
+        go func() {
+                defer loops.Done()
+                m.runSyncLoop(ctx)
+        }()
+        go func() {
+                defer loops.Done()
+                m.runServerCheckLoop(ctx)
+        }()
+        go func() {
+                loops.Wait()
+                close(m.done)
+        }()
+        return nil
+}
+
+// Stop cancels the loops, waits for them to return before the deadline of ctx and saves the tree
+func (m *Monitor) Stop(ctx context.Context) error {
+        m.mu.Lock()
+        cancel, done := m.cancel, m.done
+        m.mu.Unlock()
+        if cancel == nil {
+                return errors.New("monitor: not started")
+        }
+
+        // The sync and check loops see the cancelled context and stop their requests and probes
+        cancel()
+        select {
+        case <-done:
+                fmt.Fprintln(m.opts.Logger, "Sync and check loops stopped.")
+        case <-ctx.Done():
+                fmt.Fprintln(m.opts.Logger, "Sync and check loops did not stop before the shutdown deadline")
+        }
+
+        // Save the tree as it is now, so the dashboard comes back with it
+        if m.opts.Store != nil {
+                if err := m.saveState(nil, nil); err != nil {
+                        return err
+                }
+                fmt.Fprintln(m.opts.Logger, "State saved.")
+        }
+        return ctx.Err()
+}
+
+// RunOnce restores the saved state, syncs until the rooms are known and runs a single check cycle.
+// The sync loop is stopped again before it returns. It cannot be combined with Start.
+func (m *Monitor) RunOnce(ctx context.Context) error {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        if m.cancel != nil {
+                return errors.New("monitor: already started")
+        }
+        if m.opts.Client == nil {
+                return errMissingClient
+        }
+
+        if m.opts.Store != nil {
+                if err := m.restoreState(); err != nil {
+                        fmt.Fprintln(m.opts.Logger, "Failed to restore state from history:", err)
+                }
+        }
+
+        ctx, cancel := context.WithCancel(ctx)
+        syncDone := make(chan struct{})
+        go func() {
+                defer close(syncDone)
+                m.runSyncLoop(ctx)
+        }()
+        defer func() {
+                cancel()
+                <-syncDone
+        }()
+
+        fmt.Fprintln(m.opts.Logger, "Waiting for the first sync...")
+        select {
+        case <-m.membership.Ready():
+        case <-ctx.Done():
+                return ctx.Err()
+        }
+        if !m.runCheckCycle(ctx) {
+                return ctx.Err()
+        }
+        return nil
+}
+
+// Tree returns the rooms and servers as a single tree for D3.js. The result must not be modified.
+func (m *Monitor) Tree() *TreeNode {
+        return m.tree.Root()
+}
+
+// Rooms returns the room nodes by room ID as of the last update. The result must not be modified.
+func (m *Monitor) Rooms() map[string]*TreeNode {
+        return m.tree.Snapshot()
+}
+
+// Results returns the results of the last completed check cycle
+func (m *Monitor) Results() map[ServerName]CheckResult {
+        m.resultsMu.Lock()
+        defer m.resultsMu.Unlock()
+        results := make(map[ServerName]CheckResult, len(m.results))
+        for server, result := range m.results {
+                results[server] = result
+        }
+        return results
+}
+
+// matrixClient adapts a *mautrix.Client to MatrixClient
+type matrixClient struct {
+        *mautrix.Client
+}
+
+// NewMatrixClient adapts a logged in *mautrix.Client for use in Options.
+// Sync replaces the Syncer of the client.
+func NewMatrixClient(client *mautrix.Client) MatrixClient {
+        return matrixClient{client}
+}
+
+func (c matrixClient) MediaURL(uri id.ContentURI) string {
+        if uri.IsEmpty() {
+                return ""
+        }
+        return fmt.Sprintf("%s/_matrix/media/v3/download/%s/%s", c.HomeserverURL, uri.Homeserver, uri.FileID)
+}
+
+func (c matrixClient) Sync(ctx context.Context, syncer mautrix.Syncer) error {
+        c.Client.Syncer = syncer
+        return c.SyncWithContext(ctx)
+}
+
+// systemClock is the Clock used when Options.Clock is not set
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,151 @@
+package monitor
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "strconv"
+        "sync"
+        "time"
+
+        "maunium.net/go/mautrix"
+)
+
+// Concurrency limits and rate limit handling for client API calls and federation probes
+// ==============================================================
+
+const (
+        // Used when the homeserver rate limits us without saying for how long
+        defaultRetryAfter = 5 * time.Second
+        maxRateLimitTries = 5
+)
+
+// apiLimiter bounds the number of concurrent client API calls and pauses all of them
+// while the homeserver is rate limiting us
+type apiLimiter struct {
+        slots   chan struct{}
+        clock   Clock
+        onError func(error) // Called with the final error of every failed call
+        logger  io.Writer
+
+        mu        sync.Mutex
+        notBefore time.Time // No new call starts before this time
+}
+
+// newAPILimiter creates a limiter that allows at most concurrency calls at the same time
+func newAPILimiter(concurrency int, clock Clock, onError func(error), logger io.Writer) *apiLimiter {
+        if concurrency < 1 {
+                concurrency = 1
+        }
+        return &apiLimiter{slots: make(chan struct{}, concurrency), clock: clock, onError: onError, logger: logger}
+}
+
+// Do runs call once a slot is free. When the homeserver answers M_LIMIT_EXCEEDED, every call
+// waits for retry_after_ms and this one is tried again, up to maxRateLimitTries times.
+func (l *apiLimiter) Do(ctx context.Context, call func() error) error {
+        for try := 1; ; try++ {
+                if err := l.acquire(ctx); err != nil {
+                        return err
+                }
+                err := call()
+                <-l.slots
+
+                delay, limited := rateLimitDelay(err)
+                if !limited || try >= maxRateLimitTries {
+                        if err != nil && l.onError != nil {
+                                l.onError(err)
+                        }
+                        return err
+                }
+
+                fmt.Fprintf(l.logger, "Rate limited by homeserver, retrying in %s (attempt %d of %d)\n", delay, try, maxRateLimitTries)
+                l.pauseUntil(l.clock.Now().Add(delay))
+        }
+}
+
+// acquire waits for a free slot and for any rate limit pause to end
+func (l *apiLimiter) acquire(ctx context.Context) error {
+        for {
+                l.mu.Lock()
+                wait := l.notBefore.Sub(l.clock.Now())
+                l.mu.Unlock()
+                if wait <= 0 {
+                        break
+                }
+
+                select {
+                case <-ctx.Done():
+                        return ctx.Err()
+                case <-l.clock.After(wait):
+                }
+        }
+
+        select {
+        case l.slots <- struct{}{}:
+                return nil
+        case <-ctx.Done():
+                return ctx.Err()
+        }
+}
+
+// pauseUntil holds back new calls until t, unless a longer pause is already in place
+func (l *apiLimiter) pauseUntil(t time.Time) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if t.After(l.notBefore) {
+                l.notBefore = t
+        }
+}
+
+// rateLimitDelay reports whether err is an M_LIMIT_EXCEEDED error and how long to wait before retrying
+func rateLimitDelay(err error) (time.Duration, bool) {
+        if err == nil || !errors.Is(err, mautrix.MLimitExceeded) {
+                return 0, false
+        }
+
+        var httpErr mautrix.HTTPError
+        if errors.As(err, &httpErr) {
+                if httpErr.RespError != nil {
+                        if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && ms > 0 {
+                                return time.Duration(ms) * time.Millisecond, true
+                        }
+                }
+                if httpErr.Response != nil && httpErr.Response.StatusCode == http.StatusTooManyRequests {
+                        if seconds, err := strconv.Atoi(httpErr.Response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+                                return time.Duration(seconds) * time.Second, true
+                        }
+                }
+        }
+        return defaultRetryAfter, true
+}
+
+// forEachLimited calls fn for every item using a pool of at most workers goroutines,
+// and returns once all items are done
+func forEachLimited[T any](items []T, workers int, fn func(T)) {
+        if workers < 1 {
+                workers = 1
+        }
+        if workers > len(items) {
+                workers = len(items)
+        }
+
+        jobs := make(chan T)
+        var wg sync.WaitGroup
+        for i := 0; i < workers; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        for item := range jobs {
+                                fn(item)
+                        }
+                }()
+        }
+
+        for _, item := range items {
+                jobs <- item
+        }
+        close(jobs)
+        wg.Wait()
+}
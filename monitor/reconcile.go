@@ -0,0 +1,76 @@
+package monitor
+
+import (
+        "fmt"
+        "time"
+
+        "maunium.net/go/mautrix/id"
+)
+
+// Reconciling the tree with the rooms the bot is in and the servers in them
+// ==============================================================
+
+// Status of room and server nodes that are no longer there, shown until the grace period ends
+const statusDeparted = "departed"
+
+// markDeparted marks a node as departed, keeping the time it first went missing
+func markDeparted(node *TreeNode, now time.Time) {
+        if node.DepartedAt == nil {
+                node.DepartedAt = &now
+        }
+        node.Status = statusDeparted
+        node.UserCount = 0
+}
+
+// departedExpired reports whether a departed node has outlived the grace period
+func departedExpired(node *TreeNode, now time.Time, grace time.Duration) bool {
+        return node.DepartedAt != nil && now.Sub(*node.DepartedAt) >= grace
+}
+
+// reconcileTree marks rooms the bot has left as departed and removes departed rooms and
+// servers once the grace period has passed. Servers without members are marked by updateRoomTree.
+func (m *Monitor) reconcileTree(now time.Time) {
+        joined := make(map[string]bool)
+        for _, roomID := range m.membership.Rooms() {
+                joined[string(roomID)] = true
+        }
+
+        m.tree.Update(func(rooms map[string]*TreeNode) {
+                for roomID, roomNode := range rooms {
+                        m.reconcileRoom(rooms, roomID, roomNode, joined[roomID], now)
+                }
+        })
+}
+
+// reconcileRoom marks, removes or prunes a single room node. It runs inside tree.Update.
+func (m *Monitor) reconcileRoom(rooms map[string]*TreeNode, roomID string, roomNode *TreeNode, joined bool, now time.Time) {
+        // The log room is never shown, even if an older version put it in the tree
+        if !joined || id.RoomID(roomID) == m.opts.LogRoom {
+                if roomNode.DepartedAt == nil {
+                        fmt.Fprintf(m.opts.Logger, "Room %s (%s) is no longer joined\n", roomID, roomNode.Name)
+                }
+                markDeparted(roomNode, now)
+                if departedExpired(roomNode, now, m.opts.DepartedGrace) {
+                        fmt.Fprintf(m.opts.Logger, "Removing departed room %s (%s)\n", roomID, roomNode.Name)
+                        delete(rooms, roomID)
+                }
+                return
+        }
+
+        // Rejoined rooms are shown as usual again
+        if roomNode.DepartedAt != nil {
+                roomNode.DepartedAt = nil
+                roomNode.Status = "ok"
+        }
+
+        // Drop departed servers whose grace period is over
+        children := roomNode.Children[:0]
+        for _, serverNode := range roomNode.Children {
+                if serverNode.Status == statusDeparted && departedExpired(serverNode, now, m.opts.DepartedGrace) {
+                        fmt.Fprintf(m.opts.Logger, "Removing departed server %s from room %s\n", serverNode.Name, roomNode.Name)
+                        continue
+                }
+                children = append(children, serverNode)
+        }
+        roomNode.Children = children
+}
@@ -0,0 +1,468 @@
+package monitor
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "math/rand"
+        "net"
+        "net/http"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// Server discovery following the "Resolving server names" section of the Matrix server-server API
+// ==============================================================
+
+const (
+        defaultFederationPort = 8448
+
+        wellKnownMaxBodySize  = 64 * 1024
+        wellKnownMaxRedirects = 10
+
+        // Caching rules recommended by the spec for .well-known responses
+        wellKnownDefaultCache  = 24 * time.Hour
+        wellKnownMaxCache      = 48 * time.Hour
+        wellKnownErrorCacheMin = 1 * time.Minute
+        wellKnownErrorCacheMax = 1 * time.Hour
+)
+
+// resolvedServer is the result of server discovery: where to connect, and which name to send
+type resolvedServer struct {
+        Address string // host:port to open the TCP connection to
+        Host    string // value of the Host header, which is also used for SNI and certificate checks
+}
+
+// TLSServerName returns the name to send in the TLS SNI extension and to validate the certificate against.
+// For IP literals this is the bare IP address, which makes crypto/tls skip SNI and check IP SANs instead.
+func (r resolvedServer) TLSServerName() string {
+        name, err := ParseServerName(r.Host)
+        if err != nil {
+                return r.Host
+        }
+        return name.Host
+}
+
+// resolveError is returned by resolveMatrixServer and records the discovery step that failed
+type resolveError struct {
+        Step ProbeStep
+        Err  error
+}
+
+func (e *resolveError) Error() string { return e.Err.Error() }
+func (e *resolveError) Unwrap() error { return e.Err }
+
+// resolveMatrixServer resolves the actual Matrix server address for a server name using the spec algorithm.
+// A non-nil trace records every step, and makes the .well-known lookup bypass the cache.
+func (m *Monitor) resolveMatrixServer(ctx context.Context, server ServerName, trace *discoveryTrace) (resolvedServer, error) {
+        hostname := server.Host
+
+        // 1. If the hostname is an IP literal, use it with the given port or 8448
+        if server.IsIPLiteral() {
+                trace.rule("1", "the server name is an IP literal, used with its port or 8448")
+                return resolvedServer{
+                        Address: joinHostPort(hostname, portOrDefault(server.Port)),
+                        Host:    server.String(),
+                }, nil
+        }
+
+        // 2. If the hostname is not an IP literal and an explicit port is given, use hostname:port
+        if server.Port != 0 {
+                trace.rule("2", "the server name has an explicit port, so no delegation is looked up")
+                if err := m.lookupHost(ctx, hostname, trace); err != nil {
+                        return resolvedServer{}, &resolveError{StepDNS, fmt.Errorf("could not resolve %s: %w", hostname, err)}
+                }
+                return resolvedServer{
+                        Address: joinHostPort(hostname, server.Port),
+                        Host:    server.String(),
+                }, nil
+        }
+
+        // 3. Try .well-known delegation
+        if delegated, err := m.lookupWellKnown(ctx, hostname, trace); err == nil {
+                return m.resolveDelegatedServer(ctx, delegated, trace)
+        }
+
+        // 4. Look for SRV record `_matrix-fed._tcp.<hostname>`
+        address, ok, srvErr := m.lookupMatrixSRV(ctx, "matrix-fed", hostname, trace)
+        if ok {
+                trace.rule("4", "no usable .well-known, using the _matrix-fed._tcp SRV record of the server name")
+                return resolvedServer{Address: address, Host: hostname}, nil
+        }
+
+        // 5. Look for SRV record `_matrix._tcp.<hostname>` (deprecated)
+        address, ok, legacyErr := m.lookupMatrixSRV(ctx, "matrix", hostname, trace)
+        if ok {
+                trace.rule("5", "no usable .well-known, using the deprecated _matrix._tcp SRV record of the server name")
+                return resolvedServer{Address: address, Host: hostname}, nil
+        }
+        if srvErr == nil {
+                srvErr = legacyErr
+        }
+
+        // 6. Fallback to hostname:8448
+        trace.rule("6", "no usable .well-known or SRV record, falling back to the server name on port 8448")
+        if err := m.lookupHost(ctx, hostname, trace); err != nil {
+                // A server name without addresses usually relies on SRV records; blame the lookup that failed
+                if srvErr != nil {
+                        return resolvedServer{}, &resolveError{StepSRV, fmt.Errorf("could not look up the SRV records of %s: %w", server, srvErr)}
+                }
+                return resolvedServer{}, &resolveError{StepDNS, fmt.Errorf("could not resolve Matrix server for %s: %w", server, err)}
+        }
+        return resolvedServer{
+                Address: joinHostPort(hostname, defaultFederationPort),
+                Host:    hostname,
+        }, nil
+}
+
+// resolveDelegatedServer applies steps 3.1 to 3.5 to the m.server value of a .well-known response
+func (m *Monitor) resolveDelegatedServer(ctx context.Context, delegated ServerName, trace *discoveryTrace) (resolvedServer, error) {
+        hostname := delegated.Host
+
+        // 3.1. The delegated hostname is an IP literal
+        if delegated.IsIPLiteral() {
+                trace.rule("3.1", "delegated by .well-known to an IP literal, used with its port or 8448")
+                return resolvedServer{
+                        Address: joinHostPort(hostname, portOrDefault(delegated.Port)),
+                        Host:    delegated.String(),
+                }, nil
+        }
+
+        // 3.2. The delegated hostname has an explicit port
+        if delegated.Port != 0 {
+                trace.rule("3.2", "delegated by .well-known to a host with an explicit port")
+                if err := m.lookupHost(ctx, hostname, trace); err != nil {
+                        return resolvedServer{}, &resolveError{StepWellKnown, fmt.Errorf("could not resolve delegated server %s: %w", hostname, err)}
+                }
+                return resolvedServer{
+                        Address: joinHostPort(hostname, delegated.Port),
+                        Host:    delegated.String(),
+                }, nil
+        }
+
+        // 3.3. SRV record `_matrix-fed._tcp.<delegated_hostname>`
+        if address, ok, _ := m.lookupMatrixSRV(ctx, "matrix-fed", hostname, trace); ok {
+                trace.rule("3.3", "delegated by .well-known to a host without port, using its _matrix-fed._tcp SRV record")
+                return resolvedServer{Address: address, Host: hostname}, nil
+        }
+
+        // 3.4. SRV record `_matrix._tcp.<delegated_hostname>` (deprecated)
+        if address, ok, _ := m.lookupMatrixSRV(ctx, "matrix", hostname, trace); ok {
+                trace.rule("3.4", "delegated by .well-known to a host without port, using its deprecated _matrix._tcp SRV record")
+                return resolvedServer{Address: address, Host: hostname}, nil
+        }
+
+        // 3.5. Fallback to delegated_hostname:8448
+        trace.rule("3.5", "delegated by .well-known to a host without port or SRV record, falling back to port 8448")
+        if err := m.lookupHost(ctx, hostname, trace); err != nil {
+                return resolvedServer{}, &resolveError{StepWellKnown, fmt.Errorf("could not resolve delegated server %s: %w", hostname, err)}
+        }
+        return resolvedServer{
+                Address: joinHostPort(hostname, defaultFederationPort),
+                Host:    hostname,
+        }, nil
+}
+
+// lookupMatrixSRV looks up `_<service>._tcp.<hostname>` and returns the address of the record to use.
+// Without a usable record, ok is false, and err is the lookup error unless the name has no records.
+func (m *Monitor) lookupMatrixSRV(ctx context.Context, service, hostname string, trace *discoveryTrace) (address string, ok bool, err error) {
+        var records []*net.SRV
+        if trace != nil {
+                records, err = trace.lookupSRV(ctx, m.opts.Resolver, service, hostname)
+        } else {
+                _, records, err = m.opts.Resolver.LookupSRV(ctx, service, "tcp", hostname)
+        }
+        var dnsErr *net.DNSError
+        if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+                return "", false, nil
+        }
+        if err != nil || len(records) == 0 {
+                return "", false, err
+        }
+
+        srv := pickSRV(records)
+        if srv == nil {
+                return "", false, nil
+        }
+        address = joinHostPort(strings.TrimSuffix(srv.Target, "."), int(srv.Port))
+        trace.selectSRV(address)
+        return address, true, nil
+}
+
+// lookupHost checks that a hostname resolves, recording the addresses in the trace
+func (m *Monitor) lookupHost(ctx context.Context, hostname string, trace *discoveryTrace) error {
+        addresses, err := m.opts.Resolver.LookupHost(ctx, hostname)
+        trace.host(hostname, addresses, err)
+        return err
+}
+
+// pickSRV selects a record following RFC 2782: lowest priority first, then a weighted random
+// choice among the records sharing that priority. A target of "." means the service is not available.
+func pickSRV(records []*net.SRV) *net.SRV {
+        candidates := make([]*net.SRV, 0, len(records))
+        for _, srv := range records {
+                if srv.Target != "." {
+                        candidates = append(candidates, srv)
+                }
+        }
+        if len(candidates) == 0 {
+                return nil
+        }
+
+        // Sort by priority, with zero-weight records first within a priority as RFC 2782 requires
+        sort.SliceStable(candidates, func(i, j int) bool {
+                if candidates[i].Priority != candidates[j].Priority {
+                        return candidates[i].Priority < candidates[j].Priority
+                }
+                return candidates[i].Weight == 0 && candidates[j].Weight != 0
+        })
+
+        // Keep only the records with the lowest priority
+        lowest := candidates[0].Priority
+        end := 1
+        for end < len(candidates) && candidates[end].Priority == lowest {
+                end++
+        }
+        candidates = candidates[:end]
+
+        total := 0
+        for _, srv := range candidates {
+                total += int(srv.Weight)
+        }
+
+        n := rand.Intn(total + 1)
+        sum := 0
+        for _, srv := range candidates {
+                sum += int(srv.Weight)
+                if sum >= n {
+                        return srv
+                }
+        }
+        return candidates[len(candidates)-1]
+}
+
+// wellKnownEntry is a cached .well-known lookup result, successful or not
+type wellKnownEntry struct {
+        Server   ServerName
+        Err      error
+        Expires  time.Time
+        Failures int // Consecutive failures, used to back off the error cache time
+}
+
+// lookupWellKnown returns the m.server value for a hostname, honouring the cache rules of the spec.
+// With a trace, the cache is neither read nor written, so that the report shows the server as it is now.
+func (m *Monitor) lookupWellKnown(ctx context.Context, hostname string, trace *discoveryTrace) (ServerName, error) {
+        if trace != nil {
+                report := &WellKnownReport{}
+                server, cacheFor, err := m.fetchWellKnown(ctx, hostname, report)
+                trace.wellKnown(report, server, cacheFor, err)
+                return server, err
+        }
+
+        now := m.opts.Clock.Now()
+
+        m.wellKnownMu.Lock()
+        entry, ok := m.wellKnownCache[hostname]
+        m.wellKnownMu.Unlock()
+        if ok && now.Before(entry.Expires) {
+                return entry.Server, entry.Err
+        }
+
+        server, cacheFor, err := m.fetchWellKnown(ctx, hostname, nil)
+        if ctx.Err() != nil {
+                // Cancelled, not a failure of the server: don't cache anything
+                return server, err
+        }
+
+        next := &wellKnownEntry{Server: server, Err: err}
+        if err != nil {
+                // Back off exponentially on repeated failures, up to the recommended hour
+                if ok && entry.Err != nil {
+                        next.Failures = entry.Failures + 1
+                }
+                cacheFor = wellKnownErrorCacheMin << next.Failures
+                if cacheFor <= 0 || cacheFor > wellKnownErrorCacheMax {
+                        cacheFor = wellKnownErrorCacheMax
+                }
+        }
+        next.Expires = now.Add(cacheFor)
+
+        m.wellKnownMu.Lock()
+        m.wellKnownCache[hostname] = next
+        m.wellKnownMu.Unlock()
+
+        return server, err
+}
+
+// fetchWellKnown requests https://<hostname>/.well-known/matrix/server, following redirects,
+// and returns the m.server value together with how long it may be cached. A non-nil report
+// receives the details of the request and response.
+func (m *Monitor) fetchWellKnown(ctx context.Context, hostname string, report *WellKnownReport) (ServerName, time.Duration, error) {
+        if report == nil {
+                report = &WellKnownReport{}
+        }
+        visited := make(map[string]bool)
+        client := &http.Client{
+                Timeout:   m.opts.ProbeTimeout,
+                Transport: m.wellKnownTransport(),
+                CheckRedirect: func(req *http.Request, via []*http.Request) error {
+                        if len(via) >= wellKnownMaxRedirects {
+                                return fmt.Errorf("stopped after %d redirects", wellKnownMaxRedirects)
+                        }
+                        if req.URL.Scheme != "https" {
+                                return fmt.Errorf("refusing to follow redirect to %s: not https", req.URL)
+                        }
+                        if visited[req.URL.String()] {
+                                return fmt.Errorf("redirect loop at %s", req.URL)
+                        }
+                        visited[req.URL.String()] = true
+                        report.Redirects = append(report.Redirects, req.URL.String())
+                        return nil
+                },
+        }
+
+        wellKnownURL := fmt.Sprintf("https://%s/.well-known/matrix/server", hostname)
+        visited[wellKnownURL] = true
+        report.URL = wellKnownURL
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnownURL, nil)
+        if err != nil {
+                return ServerName{}, 0, err
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+                return ServerName{}, 0, err
+        }
+        defer resp.Body.Close()
+
+        report.Status = resp.Status
+        report.ContentType = resp.Header.Get("Content-Type")
+        body, err := io.ReadAll(io.LimitReader(resp.Body, wellKnownMaxBodySize))
+        if len(report.Redirects) == 0 {
+                // Only the server itself gets its answer shown, not whatever a redirect pointed at
+                report.Body = truncateBody(body)
+        }
+        if resp.StatusCode != http.StatusOK {
+                return ServerName{}, 0, fmt.Errorf("unexpected status %s", resp.Status)
+        }
+        if err != nil {
+                return ServerName{}, 0, err
+        }
+
+        var result struct {
+                Server string `json:"m.server"`
+        }
+        if err := json.Unmarshal(body, &result); err != nil {
+                return ServerName{}, 0, fmt.Errorf("invalid JSON: %w", err)
+        }
+        if result.Server == "" {
+                return ServerName{}, 0, errors.New("missing m.server")
+        }
+        report.MServer = result.Server
+        delegated, err := ParseServerName(result.Server)
+        if err != nil {
+                return ServerName{}, 0, fmt.Errorf("invalid m.server: %w", err)
+        }
+
+        return delegated, wellKnownCacheDuration(resp.Header, m.opts.Clock.Now()), nil
+}
+
+// wellKnownTransport derives the transport of .well-known requests from Options.Transport. The server
+// name, and every redirect, is untrusted input, so it resolves hosts itself and only connects to public
+// addresses: a .well-known lookup must not reach the loopback, link-local or private networks of the monitor.
+func (m *Monitor) wellKnownTransport() *http.Transport {
+        transport := m.opts.Transport.Clone()
+        dial := transport.DialContext
+        if dial == nil {
+                dial = (&net.Dialer{Timeout: m.opts.ProbeTimeout}).DialContext
+        }
+        transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+                host, port, err := net.SplitHostPort(address)
+                if err != nil {
+                        return nil, err
+                }
+                addresses := []string{host}
+                if net.ParseIP(host) == nil {
+                        if addresses, err = m.opts.Resolver.LookupHost(ctx, host); err != nil {
+                                return nil, err
+                        }
+                }
+
+                err = fmt.Errorf("no addresses for %s", host)
+                for _, addr := range addresses {
+                        if ip := net.ParseIP(addr); ip == nil || !isPublicIP(ip) {
+                                err = fmt.Errorf("refusing to connect to %s: %s is not a public address", host, addr)
+                                continue
+                        }
+                        conn, dialErr := dial(ctx, network, net.JoinHostPort(addr, port))
+                        if dialErr == nil {
+                                return conn, nil
+                        }
+                        err = dialErr
+                }
+                return nil, err
+        }
+        // A proxy would hide the address actually connected to
+        transport.Proxy = nil
+        transport.DisableKeepAlives = true
+        return transport
+}
+
+// isPublicIP reports whether an address is reachable on the internet, as opposed to the loopback,
+// link-local, private or unspecified addresses
+func isPublicIP(ip net.IP) bool {
+        return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+                !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// wellKnownCacheDuration works out how long a .well-known response may be cached from its
+// Cache-Control and Expires headers, using the spec's 24 hour default and 48 hour cap
+func wellKnownCacheDuration(header http.Header, now time.Time) time.Duration {
+        duration := wellKnownDefaultCache
+
+        if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+                for _, directive := range strings.Split(cacheControl, ",") {
+                        directive = strings.ToLower(strings.TrimSpace(directive))
+                        switch {
+                        case directive == "no-store" || directive == "no-cache":
+                                return 0
+                        case strings.HasPrefix(directive, "max-age="):
+                                seconds, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`))
+                                if err == nil {
+                                        duration = time.Duration(seconds) * time.Second
+                                }
+                        }
+                }
+        } else if expires := header.Get("Expires"); expires != "" {
+                if t, err := http.ParseTime(expires); err == nil {
+                        duration = t.Sub(now)
+                } else {
+                        // An invalid Expires header means the response is already expired
+                        duration = 0
+                }
+        }
+
+        if duration < 0 {
+                return 0
+        }
+        if duration > wellKnownMaxCache {
+                return wellKnownMaxCache
+        }
+        return duration
+}
+
+// joinHostPort formats host and port as an address, adding brackets around IPv6 literals
+func joinHostPort(host string, port int) string {
+        return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// portOrDefault returns the port, or the default federation port when none was given
+func portOrDefault(port int) int {
+        if port == 0 {
+                return defaultFederationPort
+        }
+        return port
+}
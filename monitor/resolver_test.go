@@ -0,0 +1,308 @@
+package monitor
+
+import (
+        "context"
+        "crypto/tls"
+        "errors"
+        "fmt"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeResolver answers from fixed tables. Hosts and SRV names that are not listed do not exist.
+type fakeResolver struct {
+        hosts map[string][]string
+        srv   map[string][]*net.SRV // By "_<service>._tcp.<name>"
+        stuck map[string]bool       // SRV names whose lookup times out
+        hang  map[string]bool       // Hosts whose lookup only ends with its context
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+        if r.hang[host] {
+                <-ctx.Done()
+                return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+        }
+        if addresses, ok := r.hosts[host]; ok {
+                return addresses, nil
+        }
+        return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+        qname := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+        if r.stuck[qname] {
+                return "", nil, &net.DNSError{Err: "i/o timeout", Name: qname, IsTimeout: true}
+        }
+        if records, ok := r.srv[qname]; ok {
+                return qname, records, nil
+        }
+        return "", nil, &net.DNSError{Err: "no such host", Name: qname, IsNotFound: true}
+}
+
+// newWellKnownServer serves /.well-known/matrix/server with the m.server given per Host, and 404 for the others.
+// The returned transport sends every connection to it.
+func newWellKnownServer(t *testing.T, delegations map[string]string) *http.Transport {
+        server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                delegated, ok := delegations[r.Host]
+                if !ok || r.URL.Path != "/.well-known/matrix/server" {
+                        http.NotFound(w, r)
+                        return
+                }
+                w.Header().Set("Content-Type", "application/json")
+                fmt.Fprintf(w, `{"m.server": %q}`, delegated)
+        }))
+        t.Cleanup(server.Close)
+
+        return &http.Transport{
+                DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+                        return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+                },
+                TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+        }
+}
+
+func TestResolveMatrixServer(t *testing.T) {
+        // Documentation addresses stand in for public ones, which .well-known requests are limited to
+        public := []string{"203.0.113.1"}
+        resolver := fakeResolver{
+                hosts: map[string][]string{
+                        "explicit.example":        public,
+                        "ip.example":              public,
+                        "port.example":            public,
+                        "matrix.port.example":     public,
+                        "fed.example":             public,
+                        "matrix.fed.example":      public,
+                        "legacy.example":          public,
+                        "matrix.legacy.example":   public,
+                        "fallback.example":        public,
+                        "matrix.fallback.example": public,
+                        "srv.example":             public,
+                        "oldsrv.example":          public,
+                        "plain.example":           public,
+                        "broken.example":          public,
+                        "private.example":         {"10.0.0.1"},
+                        "matrix.private.example":  public,
+                },
+                srv: map[string][]*net.SRV{
+                        "_matrix-fed._tcp.matrix.fed.example":    {{Target: "fed-host.example.", Port: 8443, Priority: 10, Weight: 1}},
+                        "_matrix-fed._tcp.matrix.legacy.example": {{Target: ".", Port: 0}},
+                        "_matrix._tcp.matrix.legacy.example":     {{Target: "legacy-host.example.", Port: 8444, Priority: 10, Weight: 1}},
+                        "_matrix-fed._tcp.srv.example":           {{Target: "srv-host.example.", Port: 8445, Priority: 10, Weight: 1}},
+                        "_matrix._tcp.srv.example":               {{Target: "ignored.example.", Port: 1, Priority: 10, Weight: 1}},
+                        "_matrix._tcp.oldsrv.example":            {{Target: "oldsrv-host.example.", Port: 8446, Priority: 10, Weight: 1}},
+                },
+                stuck: map[string]bool{"_matrix-fed._tcp.stuck.example": true},
+        }
+        transport := newWellKnownServer(t, map[string]string{
+                "ip.example":       "[2001:db8::5]",
+                "port.example":     "matrix.port.example:443",
+                "fed.example":      "matrix.fed.example",
+                "legacy.example":   "matrix.legacy.example",
+                "fallback.example": "matrix.fallback.example",
+                "broken.example":   "missing.example",
+                "private.example":  "matrix.private.example:443",
+        })
+        m, err := New(Options{Resolver: resolver, Transport: transport, Registerer: prometheus.NewRegistry()})
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                server   string
+                rule     string
+                address  string
+                host     string
+                failStep ProbeStep // Set when discovery must fail at this step
+        }{
+                {server: "1.2.3.4", rule: "1", address: "1.2.3.4:8448", host: "1.2.3.4"},
+                {server: "[2001:db8::1]:8080", rule: "1", address: "[2001:db8::1]:8080", host: "[2001:db8::1]:8080"},
+                {server: "explicit.example:8080", rule: "2", address: "explicit.example:8080", host: "explicit.example:8080"},
+                {server: "missing.example:8080", rule: "2", failStep: StepDNS},
+                {server: "ip.example", rule: "3.1", address: "[2001:db8::5]:8448", host: "[2001:db8::5]"},
+                {server: "port.example", rule: "3.2", address: "matrix.port.example:443", host: "matrix.port.example:443"},
+                {server: "fed.example", rule: "3.3", address: "fed-host.example:8443", host: "matrix.fed.example"},
+                {server: "legacy.example", rule: "3.4", address: "legacy-host.example:8444", host: "matrix.legacy.example"},
+                {server: "fallback.example", rule: "3.5", address: "matrix.fallback.example:8448", host: "matrix.fallback.example"},
+                {server: "broken.example", rule: "3.5", failStep: StepWellKnown},
+                {server: "srv.example", rule: "4", address: "srv-host.example:8445", host: "srv.example"},
+                {server: "oldsrv.example", rule: "5", address: "oldsrv-host.example:8446", host: "oldsrv.example"},
+                {server: "plain.example", rule: "6", address: "plain.example:8448", host: "plain.example"},
+                {server: "missing.example", rule: "6", failStep: StepDNS},
+                {server: "stuck.example", rule: "6", failStep: StepSRV},
+                {server: "stuck.example:8080", rule: "2", failStep: StepDNS},
+
+                // The .well-known of a host on a private address is not fetched, so its delegation is not followed
+                {server: "private.example", rule: "6", address: "private.example:8448", host: "private.example"},
+        }
+        for _, tt := range tests {
+                server, err := ParseServerName(tt.server)
+                if err != nil {
+                        t.Fatalf("ParseServerName(%q) failed: %v", tt.server, err)
+                }
+                trace := &discoveryTrace{report: &DelegationReport{}}
+                resolved, err := m.resolveMatrixServer(context.Background(), server, trace)
+                if got := trace.report.Rule; got != tt.rule {
+                        t.Errorf("%s: decided by step %q, want %q", tt.server, got, tt.rule)
+                }
+                if tt.failStep != "" {
+                        var resolveErr *resolveError
+                        if !errors.As(err, &resolveErr) || resolveErr.Step != tt.failStep {
+                                t.Errorf("%s: resolved to %+v with error %v, want a failure at step %q", tt.server, resolved, err, tt.failStep)
+                        }
+                        continue
+                }
+                if err != nil {
+                        t.Errorf("%s: failed: %v", tt.server, err)
+                        continue
+                }
+                if resolved.Address != tt.address || resolved.Host != tt.host {
+                        t.Errorf("%s: resolved to %s with Host %s, want %s with Host %s", tt.server, resolved.Address, resolved.Host, tt.address, tt.host)
+                }
+
+                // Without a trace the cached path must come to the same result
+                cached, err := m.resolveMatrixServer(context.Background(), server, nil)
+                if err != nil || cached != resolved {
+                        t.Errorf("%s: without a trace resolved to %+v (error %v), want %+v", tt.server, cached, err, resolved)
+                }
+        }
+}
+
+func TestCheckServerDiscoveryTimeout(t *testing.T) {
+        resolver := fakeResolver{hang: map[string]bool{"hang.example": true}}
+        m, err := New(Options{
+                Resolver:     resolver,
+                Transport:    newWellKnownServer(t, nil),
+                ProbeTimeout: 100 * time.Millisecond,
+                Registerer:   prometheus.NewRegistry(),
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        // Discovery must give up after the probe timeout, well before the caller does
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        start := time.Now()
+        result := m.CheckServer(ctx, ServerName{Host: "hang.example"})
+        if elapsed := time.Since(start); elapsed > 2*time.Second {
+                t.Errorf("check took %s with a probe timeout of 100ms", elapsed)
+        }
+        if result.Check.OK() {
+                t.Errorf("check of a server that cannot be resolved is %s", result.Status)
+        }
+}
+
+func TestPickSRV(t *testing.T) {
+        if got := pickSRV(nil); got != nil {
+                t.Errorf("pickSRV(nil) = %+v, want nil", got)
+        }
+        if got := pickSRV([]*net.SRV{{Target: ".", Port: 0}}); got != nil {
+                t.Errorf("pickSRV of a \".\" target = %+v, want nil", got)
+        }
+
+        // The lowest priority wins, whatever the weights and the order; "." only says the service is not there
+        records := []*net.SRV{
+                {Target: "backup.example.", Port: 1, Priority: 20, Weight: 100},
+                {Target: "primary.example.", Port: 2, Priority: 10, Weight: 0},
+                {Target: ".", Priority: 5},
+        }
+        for i := 0; i < 100; i++ {
+                if got := pickSRV(records); got == nil || got.Target != "primary.example." {
+                        t.Fatalf("pickSRV picked %+v, want primary.example.", got)
+                }
+        }
+
+        // Within a priority, RFC 2782 draws a number from 0 to the sum of the weights, inclusive, and picks the
+        // first record whose running sum reaches it. Zero-weight records come first and win only on a draw of 0.
+        tests := []struct {
+                weights []uint16
+                want    []float64 // Share of the picks of each record
+        }{
+                {[]uint16{1, 3}, []float64{2.0 / 5, 3.0 / 5}},
+                {[]uint16{0, 4}, []float64{1.0 / 5, 4.0 / 5}},
+                {[]uint16{4, 0}, []float64{4.0 / 5, 1.0 / 5}},
+                {[]uint16{0, 0}, []float64{1, 0}},
+        }
+        const rounds = 10000
+        for _, tt := range tests {
+                records := []*net.SRV{{Target: "other.example.", Priority: 20, Weight: 1000}}
+                for i, weight := range tt.weights {
+                        records = append(records, &net.SRV{Target: fmt.Sprintf("%d.example.", i), Priority: 10, Weight: weight})
+                }
+                picked := make(map[string]int)
+                for i := 0; i < rounds; i++ {
+                        picked[pickSRV(records).Target]++
+                }
+                if picked["other.example."] != 0 {
+                        t.Errorf("weights %v: picked a record of a higher priority %d times", tt.weights, picked["other.example."])
+                }
+                for i, want := range tt.want {
+                        share := float64(picked[fmt.Sprintf("%d.example.", i)]) / rounds
+                        if share < want-0.03 || share > want+0.03 {
+                                t.Errorf("weights %v: picked record %d in %.1f%% of the rounds, want %.1f%%", tt.weights, i, share*100, want*100)
+                        }
+                }
+        }
+}
+
+func TestWellKnownCacheDuration(t *testing.T) {
+        now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+        tests := []struct {
+                name   string
+                header http.Header
+                want   time.Duration
+        }{
+                {"no headers", http.Header{}, 24 * time.Hour},
+                {"max-age", http.Header{"Cache-Control": {"max-age=3600"}}, time.Hour},
+                {"max-age among directives", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+                {"quoted max-age", http.Header{"Cache-Control": {`max-age="120"`}}, 2 * time.Minute},
+                {"max-age above the cap", http.Header{"Cache-Control": {"max-age=604800"}}, 48 * time.Hour},
+                {"negative max-age", http.Header{"Cache-Control": {"max-age=-5"}}, 0},
+                {"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 24 * time.Hour},
+                {"no-store", http.Header{"Cache-Control": {"no-store"}}, 0},
+                {"no-cache", http.Header{"Cache-Control": {"max-age=3600, No-Cache"}}, 0},
+                {"Expires", http.Header{"Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)}}, 2 * time.Hour},
+                {"Expires in the past", http.Header{"Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 0},
+                {"invalid Expires", http.Header{"Expires": {"0"}}, 0},
+                {"Cache-Control over Expires", http.Header{
+                        "Cache-Control": {"max-age=60"},
+                        "Expires":       {now.Add(2 * time.Hour).Format(http.TimeFormat)},
+                }, time.Minute},
+        }
+        for _, tt := range tests {
+                if got := wellKnownCacheDuration(tt.header, now); got != tt.want {
+                        t.Errorf("%s: cached for %s, want %s", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestIsPublicIP(t *testing.T) {
+        tests := []struct {
+                ip   string
+                want bool
+        }{
+                {"203.0.113.1", true},
+                {"2001:db8::1", true},
+                {"127.0.0.1", false},
+                {"::1", false},
+                {"10.1.2.3", false},
+                {"172.16.0.1", false},
+                {"192.168.1.1", false},
+                {"fd00::1", false},
+                {"169.254.169.254", false},
+                {"fe80::1", false},
+                {"0.0.0.0", false},
+                {"::", false},
+                {"224.0.0.1", false},
+        }
+        for _, tt := range tests {
+                if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+                        t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+                }
+        }
+}
@@ -0,0 +1,281 @@
+package monitor
+
+import (
+        "context"
+        "fmt"
+        "io"
+        "strings"
+        "sync"
+        "time"
+
+        "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/event"
+        "maunium.net/go/mautrix/id"
+)
+
+// Room and server nodes of the tree, kept in line with the tracked membership
+// ==============================================================
+
+// collectRoomServers lists the servers of every tracked room, except the log room and rooms left out
+// of Options.Rooms, updating their nodes in the tree from the tracked membership
+func (m *Monitor) collectRoomServers(ctx context.Context) []roomServer {
+        var roomServers []roomServer
+        var mu sync.Mutex
+        forEachLimited(m.membership.Rooms(), m.opts.APIConcurrency, func(roomID id.RoomID) {
+                // Skip the log room
+                if roomID == m.opts.LogRoom {
+                        fmt.Fprintf(m.opts.Logger, "Skipping log room: %s\n", m.opts.LogRoom)
+                        return
+                }
+                if len(m.opts.Rooms) > 0 && !containsRoom(m.opts.Rooms, roomID) {
+                        return
+                }
+
+                servers := m.updateRoomTree(ctx, roomID)
+                mu.Lock()
+                roomServers = append(roomServers, servers...)
+                mu.Unlock()
+        })
+        return roomServers
+}
+
+func containsRoom(rooms []id.RoomID, roomID id.RoomID) bool {
+        for _, room := range rooms {
+                if room == roomID {
+                        return true
+                }
+        }
+        return false
+}
+
+// updateRoomTree sets the user counts of the server nodes of a room from the tracked membership
+// and returns the servers currently in the room. Servers without members are marked as departed.
+func (m *Monitor) updateRoomTree(ctx context.Context, roomID id.RoomID) []roomServer {
+        // Make sure the room has a node in the tree
+        m.ensureRoomNode(ctx, string(roomID))
+
+        counts := m.membership.ServerCounts(roomID)
+        now := m.opts.Clock.Now()
+
+        var servers []roomServer
+        m.tree.Update(func(rooms map[string]*TreeNode) {
+                servers = updateRoomServers(rooms, string(roomID), counts, now, m.opts.Logger)
+        })
+        return servers
+}
+
+// updateRoomServers applies the per-server user counts of a room to its node. It runs inside tree.Update.
+func updateRoomServers(rooms map[string]*TreeNode, roomID string, counts map[ServerName]int, now time.Time, logger io.Writer) []roomServer {
+        roomNode, ok := rooms[roomID]
+        if !ok {
+                fmt.Fprintf(logger, "Failed to retrieve room node for %s\n", roomID)
+                return nil
+        }
+
+        present := make(map[string]bool, len(counts))
+        var servers []roomServer
+        for server, userCount := range counts {
+                serverNode := getOrCreateServerNode(roomNode, server)
+                serverNode.UserCount = userCount // Set the user count for this server in this room
+                if serverNode.DepartedAt != nil {
+                        // Back in the room; the next check sets its status
+                        serverNode.DepartedAt = nil
+                        serverNode.Status = "unknown"
+                }
+                present[serverNode.Name] = true
+                servers = append(servers, roomServer{
+                        RoomID:    roomID,
+                        RoomName:  roomNode.Name,
+                        Server:    server,
+                        UserCount: userCount,
+                })
+        }
+        for _, serverNode := range roomNode.Children {
+                if !present[serverNode.Name] {
+                        if serverNode.DepartedAt == nil {
+                                fmt.Fprintf(logger, "Server %s has no members left in room %s\n", serverNode.Name, roomNode.Name)
+                        }
+                        markDeparted(serverNode, now)
+                }
+        }
+        return servers
+}
+
+// ensureRoomNode creates a room node in the tree unless it already exists
+func (m *Monitor) ensureRoomNode(ctx context.Context, roomID string) {
+    // Nothing to do if the room node exists
+    if m.tree.Has(roomID) {
+        return
+    }
+
+    // Create a new room node
+    name, avatar := m.getRoomNameAndAvatar(ctx, id.RoomID(roomID))
+    roomNode := &TreeNode{
+        Name:     name,
+        Avatar:   avatar,
+        Status:   "ok",          // Default room status
+        Children: []*TreeNode{},
+    }
+
+    // Store the new room node in the tree, unless another goroutine was faster
+    m.tree.Update(func(rooms map[string]*TreeNode) {
+        if _, ok := rooms[roomID]; !ok {
+            rooms[roomID] = roomNode
+        }
+    })
+}
+
+// refreshRoomNode updates the name and avatar of an existing room node after they changed
+func (m *Monitor) refreshRoomNode(ctx context.Context, roomID id.RoomID) {
+    if !m.tree.Has(string(roomID)) {
+        return
+    }
+
+    name, avatar := m.getRoomNameAndAvatar(ctx, roomID)
+    m.tree.Update(func(rooms map[string]*TreeNode) {
+        if roomNode, ok := rooms[string(roomID)]; ok {
+            roomNode.Name = name
+            roomNode.Avatar = avatar
+        }
+    })
+    fmt.Fprintf(m.opts.Logger, "Updated details of room %s: %s\n", roomID, name)
+}
+
+// getRoomNameAndAvatar returns the display name of a room node ("Room Title - Room Alias") and its avatar URL
+func (m *Monitor) getRoomNameAndAvatar(ctx context.Context, roomID id.RoomID) (string, string) {
+    // Fetch room details (title and alias)
+    roomAlias, roomTitle := m.getRoomDetails(ctx, roomID)
+
+    // Ensure the room alias starts with a single #
+    if !strings.HasPrefix(roomAlias, "#") {
+        roomAlias = "#" + roomAlias
+    }
+
+    // Format the name as "Room Title - Room Alias"
+    formattedName := fmt.Sprintf("%s - %s", roomTitle, roomAlias)
+
+    return formattedName, m.FetchAvatarURL(ctx, roomID, "") // Fetch the room avatar
+}
+
+
+// findServerNode returns the node of a server in a room, or nil if there is none
+func findServerNode(roomNode *TreeNode, server ServerName) *TreeNode {
+        for _, child := range roomNode.Children {
+                if child.Name == server.String() {
+                        return child
+                }
+        }
+        return nil
+}
+
+// getOrCreateServerNode fetches or creates a server node in a room
+func getOrCreateServerNode(roomNode *TreeNode, server ServerName) *TreeNode {
+        // Check if the server already exists in the room
+        if serverNode := findServerNode(roomNode, server); serverNode != nil {
+                return serverNode
+        }
+
+        // Create a new server node with default status "unknown"
+        serverNode := &TreeNode{
+                Name:   server.String(),
+                Status: "unknown",
+        }
+
+        // Add the new server node to the room
+        roomNode.Children = append(roomNode.Children, serverNode)
+        return serverNode
+}
+
+
+
+const CanonicalAliasEventType = "m.room.canonical_alias" // Define the event type as a string
+
+// getRoomDetails fetches the main alias and title of a room
+func (m *Monitor) getRoomDetails(ctx context.Context, roomID id.RoomID) (string, string) {
+        client := m.opts.Client
+
+        // Fetch the room name (title)
+        var roomName struct {
+                Name string `json:"name"`
+        }
+        err := m.apiLimit.Do(ctx, func() error {
+                return client.StateEvent(ctx, roomID, event.StateRoomName, "", &roomName)
+        })
+        if err != nil || roomName.Name == "" {
+                roomName.Name = "(unknown title)"
+        }
+
+        // Fetch the canonical alias
+        canonicalAliasType := event.NewEventType("m.room.canonical_alias") // Create the type for m.room.canonical_alias
+        var canonicalAlias struct {
+                Alias string `json:"alias"`
+        }
+        err = m.apiLimit.Do(ctx, func() error {
+                return client.StateEvent(ctx, roomID, canonicalAliasType, "", &canonicalAlias)
+        })
+        if err != nil || canonicalAlias.Alias == "" {
+                fmt.Fprintf(m.opts.Logger, "No canonical alias found for room %s\n", roomID)
+                return roomID.String(), roomName.Name // Use Room ID as fallback for alias
+        }
+
+        // Use the canonical alias as the main alias
+        return canonicalAlias.Alias, roomName.Name
+}
+
+
+
+
+
+// FetchAvatarURL fetches the avatar URL for a given user or room
+func (m *Monitor) FetchAvatarURL(ctx context.Context, roomID id.RoomID, userID id.UserID) string {
+        fmt.Fprintf(m.opts.Logger, "FetchAvatarURL called with roomID: %s, userID: %s\n", roomID, userID)
+        client := m.opts.Client
+
+        // Helper function to construct the full URL for MXC URIs
+        buildFullAvatarURL := client.MediaURL
+
+        // Fetch for user avatar
+        if userID != "" {
+                fmt.Fprintf(m.opts.Logger, "Fetching User Avatar URL: %s\n", userID)
+                var profile *mautrix.RespUserProfile
+                err := m.apiLimit.Do(ctx, func() (err error) {
+                        profile, err = client.GetProfile(ctx, userID)
+                        return err
+                })
+                if err == nil && !profile.AvatarURL.IsEmpty() {
+                        fmt.Fprintf(m.opts.Logger, "User Avatar URL: %s\n", profile.AvatarURL)
+                        return buildFullAvatarURL(profile.AvatarURL)
+                }
+                // Generate a placeholder if no avatar is found
+                username := string(userID)
+                if len(username) > 0 {
+                        firstLetter := string(username[1]) // Skip the `@` in the username
+                        return fmt.Sprintf("https://dummyimage.com/24x24/0074D9/FFFFFF.png&text=%s", firstLetter)
+                }
+                return "https://dummyimage.com/24x24/0074D9/FFFFFF.png&text=B" // Default bot avatar
+        }
+
+        // Fetch for room avatar
+        if roomID != "" {
+                fmt.Fprintf(m.opts.Logger, "Fetching Room Avatar URL: %s\n", roomID)
+                var roomAvatar struct {
+                        AvatarURL id.ContentURI `json:"url"`
+                }
+                err := m.apiLimit.Do(ctx, func() error {
+                        return client.StateEvent(ctx, roomID, event.StateRoomAvatar, "", &roomAvatar)
+                })
+                if err == nil && !roomAvatar.AvatarURL.IsEmpty() {
+                        fmt.Fprintf(m.opts.Logger, "Room Avatar URL: %s\n", roomAvatar.AvatarURL)
+                        return buildFullAvatarURL(roomAvatar.AvatarURL)
+                }
+                // Generate a placeholder if no avatar is found
+                roomName := string(roomID)
+                if len(roomName) > 0 {
+                        firstLetter := string(roomName[1]) // Skip the `!` in the room ID
+                        return fmt.Sprintf("https://dummyimage.com/24x24/FF4136/FFFFFF.png&text=%s", firstLetter)
+                }
+                return "https://dummyimage.com/24x24/FF4136/FFFFFF.png&text=R" // Default room avatar
+        }
+
+        return ""
+}
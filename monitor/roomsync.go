@@ -0,0 +1,330 @@
+package monitor
+
+import (
+        "context"
+        "fmt"
+        "io"
+        "sync"
+        "time"
+
+        "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/event"
+        "maunium.net/go/mautrix/id"
+)
+
+// Event-driven room tracking: a /sync loop keeps room membership and details current
+// ==============================================================
+
+// Time to wait before restarting the sync loop after it stopped with an error
+const syncRestartDelay = 10 * time.Second
+
+// Event types the sync filter asks for; everything else is filtered out by the homeserver
+var trackedEventTypes = []event.Type{
+        event.StateMember,
+        event.StateRoomName,
+        event.StateCanonicalAlias,
+        event.StateRoomAvatar,
+}
+
+// Timeline events also include messages, for the commands in the log room
+var timelineEventTypes = []event.Type{
+        event.StateMember,
+        event.StateRoomName,
+        event.StateCanonicalAlias,
+        event.StateRoomAvatar,
+        event.EventMessage,
+}
+
+// allEventTypes matches every event type in a filter
+var allEventTypes = []event.Type{event.NewEventType("*")}
+
+// roomMembership keeps the joined members of every room the bot is in
+type roomMembership struct {
+        mu    sync.Mutex
+        rooms map[id.RoomID]map[id.UserID]bool
+
+        ready     chan struct{} // Closed once the first sync has been processed
+        readyOnce sync.Once
+
+        logger io.Writer
+}
+
+func newRoomMembership(logger io.Writer) *roomMembership {
+        return &roomMembership{
+                rooms:  make(map[id.RoomID]map[id.UserID]bool),
+                ready:  make(chan struct{}),
+                logger: logger,
+        }
+}
+
+// Seed replaces the members of a room, e.g. with the result of JoinedMembers
+func (m *roomMembership) Seed(roomID id.RoomID, members []id.UserID) {
+        joined := make(map[id.UserID]bool, len(members))
+        for _, userID := range members {
+                joined[userID] = true
+        }
+
+        m.mu.Lock()
+        m.rooms[roomID] = joined
+        m.mu.Unlock()
+}
+
+// Has reports whether the members of a room are known
+func (m *roomMembership) Has(roomID id.RoomID) bool {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        _, ok := m.rooms[roomID]
+        return ok
+}
+
+// SetMember records a user joining or leaving a known room and reports whether anything changed
+func (m *roomMembership) SetMember(roomID id.RoomID, userID id.UserID, joined bool) bool {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        members, ok := m.rooms[roomID]
+        if !ok || members[userID] == joined {
+                return false
+        }
+        if joined {
+                members[userID] = true
+        } else {
+                delete(members, userID)
+        }
+        return true
+}
+
+// Remove forgets a room the bot has left
+func (m *roomMembership) Remove(roomID id.RoomID) {
+        m.mu.Lock()
+        delete(m.rooms, roomID)
+        m.mu.Unlock()
+}
+
+// Rooms returns the IDs of all known rooms
+func (m *roomMembership) Rooms() []id.RoomID {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        rooms := make([]id.RoomID, 0, len(m.rooms))
+        for roomID := range m.rooms {
+                rooms = append(rooms, roomID)
+        }
+        return rooms
+}
+
+// ServerCounts returns the number of joined users per server in a room
+func (m *roomMembership) ServerCounts(roomID id.RoomID) map[ServerName]int {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        counts := make(map[ServerName]int)
+        for userID := range m.rooms[roomID] {
+                server, err := extractDomain(string(userID))
+                if err != nil {
+                        fmt.Fprintf(m.logger, "Skipping user %s in room %s: %v\n", userID, roomID, err)
+                        continue
+                }
+                counts[server]++
+        }
+        return counts
+}
+
+// ServerUsers returns the number of distinct joined users per server across all rooms except skip
+func (m *roomMembership) ServerUsers(skip id.RoomID) map[ServerName]int {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        users := make(map[id.UserID]bool)
+        for roomID, members := range m.rooms {
+                if roomID == skip {
+                        continue
+                }
+                for userID := range members {
+                        users[userID] = true
+                }
+        }
+
+        counts := make(map[ServerName]int)
+        for userID := range users {
+                if server, err := extractDomain(string(userID)); err == nil {
+                        counts[server]++
+                }
+        }
+        return counts
+}
+
+// ServerRooms returns the number of rooms, except skip, that each server has joined users in
+func (m *roomMembership) ServerRooms(skip id.RoomID) map[ServerName]int {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        counts := make(map[ServerName]int)
+        for roomID, members := range m.rooms {
+                if roomID == skip {
+                        continue
+                }
+                servers := make(map[ServerName]bool)
+                for userID := range members {
+                        if server, err := extractDomain(string(userID)); err == nil {
+                                servers[server] = true
+                        }
+                }
+                for server := range servers {
+                        counts[server]++
+                }
+        }
+        return counts
+}
+
+// Ready returns a channel that is closed once the first sync has been processed
+func (m *roomMembership) Ready() <-chan struct{} {
+        return m.ready
+}
+
+func (m *roomMembership) markReady() {
+        m.readyOnce.Do(func() { close(m.ready) })
+}
+
+// roomSyncer wraps the default syncer to learn when a sync response has been fully processed
+type roomSyncer struct {
+        *mautrix.DefaultSyncer
+        membership *roomMembership
+}
+
+// ProcessResponse dispatches the events of a sync response, then marks the membership as ready
+func (s roomSyncer) ProcessResponse(ctx context.Context, resp *mautrix.RespSync, since string) error {
+        err := s.DefaultSyncer.ProcessResponse(ctx, resp, since)
+        if err == nil {
+                s.membership.markReady()
+        }
+        return err
+}
+
+// newRoomSyncer creates the syncer with a lazy-loading filter and the handlers that keep
+// membership and the tree current
+func (m *Monitor) newRoomSyncer() roomSyncer {
+        syncer := mautrix.NewDefaultSyncer()
+        syncer.FilterJSON = &mautrix.Filter{
+                AccountData: mautrix.FilterPart{NotTypes: allEventTypes},
+                Presence:    mautrix.FilterPart{NotTypes: allEventTypes},
+                Room: mautrix.RoomFilter{
+                        AccountData: mautrix.FilterPart{NotTypes: allEventTypes},
+                        Ephemeral:   mautrix.FilterPart{NotTypes: allEventTypes},
+                        State: mautrix.FilterPart{
+                                LazyLoadMembers: true,
+                                Types:           trackedEventTypes,
+                        },
+                        Timeline: mautrix.FilterPart{
+                                LazyLoadMembers: true,
+                                Limit:           50,
+                                Types:           timelineEventTypes,
+                        },
+                },
+        }
+
+        // Rooms joined or left, and rooms whose timeline has a gap, run before the events are dispatched
+        syncer.OnSync(func(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+                var seed []id.RoomID
+                for roomID, room := range resp.Rooms.Join {
+                        if m.opts.LogRoom == roomID {
+                                continue
+                        }
+                        if !m.membership.Has(roomID) || room.Timeline.Limited {
+                                seed = append(seed, roomID)
+                        }
+                }
+                forEachLimited(seed, m.opts.APIConcurrency, func(roomID id.RoomID) {
+                        m.seedRoomMembers(ctx, roomID)
+                })
+
+                left := false
+                for roomID := range resp.Rooms.Leave {
+                        if m.membership.Has(roomID) {
+                                fmt.Fprintf(m.opts.Logger, "Left room %s\n", roomID)
+                                m.membership.Remove(roomID)
+                                left = true
+                        }
+                }
+                if left {
+                        m.reconcileTree(m.opts.Clock.Now())
+                }
+                return true
+        })
+
+        // Membership changes update the tree right away
+        syncer.OnEventType(event.StateMember, func(ctx context.Context, evt *event.Event) {
+                if evt.StateKey == nil {
+                        return
+                }
+                joined := evt.Content.AsMember().Membership == event.MembershipJoin
+                if m.membership.SetMember(evt.RoomID, id.UserID(*evt.StateKey), joined) {
+                        fmt.Fprintf(m.opts.Logger, "Membership of %s in %s changed (joined: %t)\n", *evt.StateKey, evt.RoomID, joined)
+                        m.updateRoomTree(ctx, evt.RoomID)
+                }
+        })
+
+        // Name, alias and avatar changes refresh the room node. The initial sync is skipped,
+        // because the room nodes were just created or restored with these details.
+        refresh := func(ctx context.Context, evt *event.Event) {
+                select {
+                case <-m.membership.Ready():
+                        m.refreshRoomNode(ctx, evt.RoomID)
+                default:
+                }
+        }
+        syncer.OnEventType(event.StateRoomName, refresh)
+        syncer.OnEventType(event.StateCanonicalAlias, refresh)
+        syncer.OnEventType(event.StateRoomAvatar, refresh)
+
+        // Commands in the log room. Messages of the initial sync were sent before we started and are skipped.
+        syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+                select {
+                case <-m.membership.Ready():
+                        m.handleCommand(ctx, evt)
+                default:
+                }
+        })
+
+        return roomSyncer{syncer, m.membership}
+}
+
+// seedRoomMembers loads the full member list of a room, since lazy loading only sends some of it
+func (m *Monitor) seedRoomMembers(ctx context.Context, roomID id.RoomID) {
+        var resp *mautrix.RespJoinedMembers
+        err := m.apiLimit.Do(ctx, func() (err error) {
+                resp, err = m.opts.Client.JoinedMembers(ctx, roomID)
+                return err
+        })
+        if err != nil {
+                fmt.Fprintf(m.opts.Logger, "Failed to get joined members for room %s: %v\n", roomID, err)
+                return
+        }
+
+        members := make([]id.UserID, 0, len(resp.Joined))
+        for userID := range resp.Joined {
+                members = append(members, userID)
+        }
+        m.membership.Seed(roomID, members)
+        fmt.Fprintf(m.opts.Logger, "Tracking room %s with %d members\n", roomID, len(members))
+        m.updateRoomTree(ctx, roomID)
+}
+
+// runSyncLoop runs /sync until ctx is cancelled, restarting it after errors
+func (m *Monitor) runSyncLoop(ctx context.Context) {
+        syncer := m.newRoomSyncer()
+        for {
+                fmt.Fprintln(m.opts.Logger, "Starting sync loop...")
+                err := m.opts.Client.Sync(ctx, syncer)
+                if ctx.Err() != nil {
+                        fmt.Fprintln(m.opts.Logger, "Sync loop stopped.")
+                        return
+                }
+                fmt.Fprintf(m.opts.Logger, "Sync loop failed: %v, restarting in %s\n", err, syncRestartDelay)
+
+                select {
+                case <-ctx.Done():
+                        return
+                case <-m.opts.Clock.After(syncRestartDelay):
+                }
+        }
+}
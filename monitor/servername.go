@@ -0,0 +1,105 @@
+package monitor
+
+import (
+        "errors"
+        "fmt"
+        "net"
+        "strconv"
+        "strings"
+)
+
+// ServerName is a Matrix server name as defined by the spec grammar:
+//
+//	server_name = hostname [ ":" port ]
+//	hostname    = IPv4address / "[" IPv6address "]" / dns-name
+//
+// It is comparable, so it can be used directly as a map key.
+type ServerName struct {
+        Host string // DNS name or IP address, without brackets for IPv6
+        Port int    // Explicit port, or 0 when none was given
+}
+
+// ParseServerName parses a server name such as "example.org", "example.org:8448", "1.2.3.4" or "[2001:db8::1]:8448"
+func ParseServerName(name string) (ServerName, error) {
+        if name == "" {
+                return ServerName{}, errors.New("empty server name")
+        }
+
+        host, portStr, hasPort := name, "", false
+        if strings.HasPrefix(name, "[") {
+                end := strings.Index(name, "]")
+                if end < 0 {
+                        return ServerName{}, fmt.Errorf("unterminated IPv6 literal in %q", name)
+                }
+                host = name[1:end]
+                if !isIPv6Literal(host) {
+                        return ServerName{}, fmt.Errorf("invalid IPv6 literal in %q", name)
+                }
+                rest := name[end+1:]
+                if rest != "" {
+                        if !strings.HasPrefix(rest, ":") {
+                                return ServerName{}, fmt.Errorf("unexpected %q after IPv6 literal in %q", rest, name)
+                        }
+                        portStr, hasPort = rest[1:], true
+                }
+        } else {
+                if i := strings.LastIndex(name, ":"); i >= 0 {
+                        host, portStr, hasPort = name[:i], name[i+1:], true
+                }
+                if strings.Contains(host, ":") {
+                        return ServerName{}, fmt.Errorf("IPv6 literal in %q must be enclosed in brackets", name)
+                }
+                if !isDNSName(host) {
+                        return ServerName{}, fmt.Errorf("invalid hostname in %q", name)
+                }
+        }
+
+        serverName := ServerName{Host: host}
+        if hasPort {
+                port, err := strconv.Atoi(portStr)
+                if err != nil || len(portStr) == 0 || len(portStr) > 5 || port < 1 || port > 65535 || strings.Trim(portStr, "0123456789") != "" {
+                        return ServerName{}, fmt.Errorf("invalid port in %q", name)
+                }
+                serverName.Port = port
+        }
+        return serverName, nil
+}
+
+// String formats the server name the way it appears in user IDs, with brackets around IPv6 literals
+func (s ServerName) String() string {
+        host := s.Host
+        if strings.Contains(host, ":") {
+                host = "[" + host + "]"
+        }
+        if s.Port != 0 {
+                return host + ":" + strconv.Itoa(s.Port)
+        }
+        return host
+}
+
+// IsIPLiteral reports whether the hostname part is an IPv4 or IPv6 address
+func (s ServerName) IsIPLiteral() bool {
+        return net.ParseIP(s.Host) != nil
+}
+
+// isDNSName checks a hostname against the dns-name rule (1 to 255 letters, digits, "-" and ".").
+// IPv4 addresses also match this rule.
+func isDNSName(host string) bool {
+        if len(host) == 0 || len(host) > 255 {
+                return false
+        }
+        for _, c := range host {
+                if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+                        return false
+                }
+        }
+        return true
+}
+
+// isIPv6Literal checks the contents of a bracketed IPv6 address
+func isIPv6Literal(host string) bool {
+        if len(host) < 2 || len(host) > 45 || !strings.Contains(host, ":") {
+                return false
+        }
+        return net.ParseIP(host) != nil
+}
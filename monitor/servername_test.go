@@ -0,0 +1,118 @@
+package monitor
+
+import "testing"
+
+func TestParseServerName(t *testing.T) {
+        tests := []struct {
+                name    string
+                want    ServerName
+                wantErr bool
+        }{
+                {name: "example.org", want: ServerName{Host: "example.org"}},
+                {name: "example.org:8448", want: ServerName{Host: "example.org", Port: 8448}},
+                {name: "matrix-1.example.org:1", want: ServerName{Host: "matrix-1.example.org", Port: 1}},
+                {name: "localhost:65535", want: ServerName{Host: "localhost", Port: 65535}},
+                {name: "1.2.3.4", want: ServerName{Host: "1.2.3.4"}},
+                {name: "1.2.3.4:8448", want: ServerName{Host: "1.2.3.4", Port: 8448}},
+                {name: "[2001:db8::1]", want: ServerName{Host: "2001:db8::1"}},
+                {name: "[2001:db8::1]:8448", want: ServerName{Host: "2001:db8::1", Port: 8448}},
+                {name: "[::1]:443", want: ServerName{Host: "::1", Port: 443}},
+
+                {name: "", wantErr: true},
+                {name: ":8448", wantErr: true},
+                {name: "example.org:", wantErr: true},
+                {name: "example.org:0", wantErr: true},
+                {name: "example.org:65536", wantErr: true},
+                {name: "example.org:+80", wantErr: true},
+                {name: "example.org:008448", wantErr: true},
+                {name: "example.org:http", wantErr: true},
+                {name: "exa_mple.org", wantErr: true},
+                {name: "example.org/path", wantErr: true},
+                {name: "2001:db8::1", wantErr: true},
+                {name: "[2001:db8::1", wantErr: true},
+                {name: "[2001:db8::1]8448", wantErr: true},
+                {name: "[1.2.3.4]", wantErr: true},
+                {name: "[not-an-ip]", wantErr: true},
+                {name: "[2001:db8::1]:", wantErr: true},
+        }
+        for _, tt := range tests {
+                got, err := ParseServerName(tt.name)
+                if tt.wantErr {
+                        if err == nil {
+                                t.Errorf("ParseServerName(%q) = %+v, want an error", tt.name, got)
+                        }
+                        continue
+                }
+                if err != nil {
+                        t.Errorf("ParseServerName(%q) failed: %v", tt.name, err)
+                        continue
+                }
+                if got != tt.want {
+                        t.Errorf("ParseServerName(%q) = %+v, want %+v", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestServerNameString(t *testing.T) {
+        for _, name := range []string{"example.org", "example.org:8448", "1.2.3.4:80", "[2001:db8::1]", "[2001:db8::1]:8448"} {
+                server, err := ParseServerName(name)
+                if err != nil {
+                        t.Fatalf("ParseServerName(%q) failed: %v", name, err)
+                }
+                if got := server.String(); got != name {
+                        t.Errorf("ParseServerName(%q).String() = %q", name, got)
+                }
+        }
+}
+
+func TestServerNameIsIPLiteral(t *testing.T) {
+        tests := []struct {
+                name string
+                want bool
+        }{
+                {"example.org", false},
+                {"example.org:8448", false},
+                {"1.2.3.4", true},
+                {"1.2.3.4:8448", true},
+                {"[2001:db8::1]:8448", true},
+        }
+        for _, tt := range tests {
+                server, err := ParseServerName(tt.name)
+                if err != nil {
+                        t.Fatalf("ParseServerName(%q) failed: %v", tt.name, err)
+                }
+                if got := server.IsIPLiteral(); got != tt.want {
+                        t.Errorf("ParseServerName(%q).IsIPLiteral() = %v, want %v", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestExtractDomain(t *testing.T) {
+        tests := []struct {
+                userID  string
+                want    ServerName
+                wantErr bool
+        }{
+                {userID: "@alice:example.org", want: ServerName{Host: "example.org"}},
+                {userID: "@bob:example.org:8448", want: ServerName{Host: "example.org", Port: 8448}},
+                {userID: "@carol:[2001:db8::1]:8448", want: ServerName{Host: "2001:db8::1", Port: 8448}},
+                {userID: "@dave", wantErr: true},
+                {userID: "@eve:", wantErr: true},
+        }
+        for _, tt := range tests {
+                got, err := extractDomain(tt.userID)
+                if tt.wantErr {
+                        if err == nil {
+                                t.Errorf("extractDomain(%q) = %+v, want an error", tt.userID, got)
+                        }
+                        continue
+                }
+                if err != nil {
+                        t.Errorf("extractDomain(%q) failed: %v", tt.userID, err)
+                        continue
+                }
+                if got != tt.want {
+                        t.Errorf("extractDomain(%q) = %+v, want %+v", tt.userID, got, tt.want)
+                }
+        }
+}
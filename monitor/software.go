@@ -0,0 +1,213 @@
+package monitor
+
+import (
+        "context"
+        "fmt"
+        "sort"
+        "strings"
+        "time"
+)
+
+// Server software inventory: which implementation and version every server runs
+// ==============================================================
+
+// ServerSoftware is the implementation and version a server reports at /_matrix/federation/v1/version.
+// Values are shared between results, the tree and the inventory and are never modified.
+type ServerSoftware struct {
+        Name    string `json:"name"`
+        Version string `json:"version"`
+}
+
+// String returns e.g. "Synapse 1.98.0", with "unknown" for missing parts
+func (s *ServerSoftware) String() string {
+        if s == nil {
+                return "unknown"
+        }
+        name, version := s.Name, s.Version
+        if name == "" {
+                name = "unknown"
+        }
+        if version == "" {
+                version = "unknown"
+        }
+        return name + " " + version
+}
+
+// Equal reports whether both describe the same software, nil meaning unknown
+func (s *ServerSoftware) Equal(other *ServerSoftware) bool {
+        if s == nil || other == nil {
+                return s == other
+        }
+        return *s == *other
+}
+
+// softwareFromVersion takes the server object out of a decoded version response.
+// Fields that are missing or not strings are left empty; nil means there was nothing at all.
+func softwareFromVersion(response map[string]interface{}) *ServerSoftware {
+        server, ok := response["server"].(map[string]interface{})
+        if !ok {
+                return nil
+        }
+        name, _ := server["name"].(string)
+        version, _ := server["version"].(string)
+        name, version = strings.TrimSpace(name), strings.TrimSpace(version)
+        if name == "" && version == "" {
+                return nil
+        }
+        return &ServerSoftware{Name: name, Version: version}
+}
+
+// reportSoftwareChanges remembers the software of every server that answered and tells the log room
+// when it changed since the previous check, including checks restored from history
+func (m *Monitor) reportSoftwareChanges(ctx context.Context, results map[ServerName]CheckResult) {
+        servers := make([]ServerName, 0, len(results))
+        for server := range results {
+                servers = append(servers, server)
+        }
+        sort.Slice(servers, func(i, j int) bool {
+                return servers[i].String() < servers[j].String()
+        })
+
+        for _, server := range servers {
+                software := results[server].Software
+                if software == nil {
+                        continue
+                }
+                previous, seen := m.software.Swap(server, software)
+                if !seen || previous.(*ServerSoftware).Equal(software) {
+                        continue
+                }
+
+                message := fmt.Sprintf("Server %s changed software from %s to %s.", server, previous.(*ServerSoftware), software)
+                fmt.Fprintln(m.opts.Logger, message)
+                if m.opts.LogRoom == "" {
+                        continue
+                }
+                if err := m.sendMessageToRoom(ctx, m.opts.LogRoom, message); err != nil {
+                        fmt.Fprintf(m.opts.Logger, "Failed to send software change for %s to log room: %v\n", server, err)
+                }
+        }
+}
+
+// InventoryEntry is one server in the inventory
+type InventoryEntry struct {
+        Server     string          `json:"server"`
+        Software   *ServerSoftware `json:"software,omitempty"` // Last software seen, possibly from an earlier cycle
+        Status     string          `json:"status"`
+        Users      int             `json:"users"` // Distinct users of the server in the tracked rooms
+        Rooms      int             `json:"rooms"`
+        CheckedAt  time.Time       `json:"checked_at"`
+        Advisories []string        `json:"advisories,omitempty"` // IDs of the advisories matching Software
+}
+
+// Inventory lists the servers of the last completed check cycle with their software, sorted by name
+func (m *Monitor) Inventory() []InventoryEntry {
+        results := m.Results()
+        users := m.membership.ServerUsers(m.opts.LogRoom)
+        rooms := m.membership.ServerRooms(m.opts.LogRoom)
+
+        inventory := make([]InventoryEntry, 0, len(results))
+        for server, result := range results {
+                entry := InventoryEntry{
+                        Server:    server.String(),
+                        Software:  result.Software,
+                        Status:    result.Confirmed,
+                        Users:     users[server],
+                        Rooms:     rooms[server],
+                        CheckedAt: result.Time,
+                }
+                if entry.Software == nil {
+                        if software, ok := m.software.Load(server); ok {
+                                entry.Software = software.(*ServerSoftware)
+                        }
+                }
+                for _, advisory := range m.matchAdvisories(entry.Software) {
+                        entry.Advisories = append(entry.Advisories, advisory.ID)
+                }
+                inventory = append(inventory, entry)
+        }
+        sort.Slice(inventory, func(i, j int) bool {
+                return inventory[i].Server < inventory[j].Server
+        })
+        return inventory
+}
+
+// CensusEntry counts the servers running one implementation, or one version of it, and the users they host
+type CensusEntry struct {
+        Name    string `json:"name"`
+        Version string `json:"version,omitempty"` // Empty in the per-implementation totals
+        Servers int    `json:"servers"`
+        Users   int    `json:"users"`
+}
+
+// Census counts servers and users by implementation and by version
+type Census struct {
+        Implementations []CensusEntry `json:"implementations"`
+        Versions        []CensusEntry `json:"versions"`
+        Servers         int           `json:"servers"`
+        Users           int           `json:"users"`
+}
+
+// Census summarises the inventory, with the implementations and versions hosting the most users first.
+// Servers that never reported their software are counted as "unknown".
+func (m *Monitor) Census() Census {
+        implementations := make(map[string]*CensusEntry)
+        versions := make(map[ServerSoftware]*CensusEntry)
+        census := Census{Implementations: []CensusEntry{}, Versions: []CensusEntry{}}
+        for _, entry := range m.Inventory() {
+                software := ServerSoftware{Name: "unknown", Version: "unknown"}
+                if entry.Software != nil {
+                        software = *entry.Software
+                        if software.Name == "" {
+                                software.Name = "unknown"
+                        }
+                        if software.Version == "" {
+                                software.Version = "unknown"
+                        }
+                }
+
+                implementation, ok := implementations[software.Name]
+                if !ok {
+                        implementation = &CensusEntry{Name: software.Name}
+                        implementations[software.Name] = implementation
+                }
+                version, ok := versions[software]
+                if !ok {
+                        version = &CensusEntry{Name: software.Name, Version: software.Version}
+                        versions[software] = version
+                }
+                for _, e := range []*CensusEntry{implementation, version} {
+                        e.Servers++
+                        e.Users += entry.Users
+                }
+                census.Servers++
+                census.Users += entry.Users
+        }
+
+        for _, e := range implementations {
+                census.Implementations = append(census.Implementations, *e)
+        }
+        for _, e := range versions {
+                census.Versions = append(census.Versions, *e)
+        }
+        sortCensus(census.Implementations)
+        sortCensus(census.Versions)
+        return census
+}
+
+// sortCensus orders entries by users, then servers, then name and version
+func sortCensus(entries []CensusEntry) {
+        sort.Slice(entries, func(i, j int) bool {
+                a, b := entries[i], entries[j]
+                if a.Users != b.Users {
+                        return a.Users > b.Users
+                }
+                if a.Servers != b.Servers {
+                        return a.Servers > b.Servers
+                }
+                if a.Name != b.Name {
+                        return a.Name < b.Name
+                }
+                return a.Version < b.Version
+        })
+}
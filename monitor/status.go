@@ -0,0 +1,238 @@
+package monitor
+
+import (
+        "context"
+        "crypto/tls"
+        "crypto/x509"
+        "errors"
+        "fmt"
+        "net"
+        "syscall"
+)
+
+// Structured probe status: what kind of failure, at which step, and why
+// ==============================================================
+
+// StatusCategory groups failures by their kind
+type StatusCategory string
+
+const (
+        CategoryOK         StatusCategory = "ok"
+        CategoryDNS        StatusCategory = "dns"        // A name did not resolve
+        CategoryDelegation StatusCategory = "delegation" // .well-known points somewhere unusable
+        CategoryConnection StatusCategory = "connection" // TCP connection failed or timed out
+        CategoryTLS        StatusCategory = "tls"        // TLS handshake or certificate problem
+        CategoryHTTP       StatusCategory = "http"       // The HTTP request failed after connecting
+        CategoryDegraded   StatusCategory = "degraded"   // The server answered, but with an error or something that is not a version
+        CategoryKeys       StatusCategory = "keys"       // The signing keys are missing, expired or do not verify
+)
+
+// ProbeStep is the step of server discovery or of the probe request where a check failed
+type ProbeStep string
+
+const (
+        StepWellKnown ProbeStep = "well-known"
+        StepSRV       ProbeStep = "srv"
+        StepDNS       ProbeStep = "dns"
+        StepConnect   ProbeStep = "connect"
+        StepTLS       ProbeStep = "tls"
+        StepHTTP      ProbeStep = "http"
+        StepKeys      ProbeStep = "keys"
+)
+
+// Error codes, stable enough to alert on
+const (
+        CodeOK                  = "ok"
+        CodeDNSNotFound         = "dns_not_found"
+        CodeDNSTimeout          = "dns_timeout"
+        CodeDNSError            = "dns_error"
+        CodeConnectionRefused   = "connection_refused"
+        CodeConnectionReset     = "connection_reset"
+        CodeHostUnreachable     = "host_unreachable"
+        CodeTimeout             = "timeout"
+        CodeConnectionFailed    = "connection_failed"
+        CodeTLSCertExpired      = "tls_cert_expired"
+        CodeTLSWrongName        = "tls_wrong_name"
+        CodeTLSUnknownAuthority = "tls_unknown_authority"
+        CodeTLSSelfSigned       = "tls_self_signed"
+        CodeTLSInvalidCert      = "tls_invalid_cert"
+        CodeTLSNotTLS           = "tls_not_tls"
+        CodeTLSHandshakeFailed  = "tls_handshake_failed"
+        CodeInvalidJSON         = "invalid_json"
+        CodeHTTPStatus          = "http_status"
+        CodeMatrixError         = "matrix_error"
+        CodeBadContentType      = "bad_content_type"
+        CodeNoServerInfo        = "no_server_info"
+        CodeHTTPError           = "http_error"
+        CodeKeysUnavailable     = "keys_unavailable"
+        CodeKeysInvalid         = "keys_invalid"
+        CodeKeysWrongServer     = "keys_wrong_server"
+        CodeKeysExpired         = "keys_expired"
+        CodeKeysBadSignature    = "keys_bad_signature"
+)
+
+// Human readable description of each error code
+var codeDescriptions = map[string]string{
+        CodeOK:                  "OK",
+        CodeDNSNotFound:         "Name not found",
+        CodeDNSTimeout:          "DNS lookup timed out",
+        CodeDNSError:            "DNS lookup failed",
+        CodeConnectionRefused:   "Connection refused",
+        CodeConnectionReset:     "Connection reset",
+        CodeHostUnreachable:     "Host unreachable",
+        CodeTimeout:             "Timed out",
+        CodeConnectionFailed:    "Connection failed",
+        CodeTLSCertExpired:      "Certificate expired or not yet valid",
+        CodeTLSWrongName:        "Certificate is for the wrong name",
+        CodeTLSUnknownAuthority: "Certificate signed by unknown authority",
+        CodeTLSSelfSigned:       "Certificate is self-signed",
+        CodeTLSInvalidCert:      "Invalid certificate",
+        CodeTLSNotTLS:           "Server does not speak TLS",
+        CodeTLSHandshakeFailed:  "TLS handshake failed",
+        CodeInvalidJSON:         "Invalid JSON response",
+        CodeHTTPStatus:          "Unexpected HTTP status",
+        CodeMatrixError:         "Matrix error response",
+        CodeBadContentType:      "Response is not JSON",
+        CodeNoServerInfo:        "Response has no server information",
+        CodeHTTPError:           "HTTP request failed",
+        CodeKeysUnavailable:     "Signing keys not available",
+        CodeKeysInvalid:         "Invalid signing key response",
+        CodeKeysWrongServer:     "Signing keys are for another server",
+        CodeKeysExpired:         "Signing keys have expired",
+        CodeKeysBadSignature:    "Signing keys are not properly signed",
+}
+
+// ProbeStatus is the typed outcome of a server check
+type ProbeStatus struct {
+        Category StatusCategory `json:"category"`
+        Code     string         `json:"code"`
+        Detail   string         `json:"detail,omitempty"` // Human readable detail, usually the underlying error
+        Step     ProbeStep      `json:"step,omitempty"`   // Step that failed, empty when OK
+}
+
+// statusOK is the status of a successful check
+var statusOK = ProbeStatus{Category: CategoryOK, Code: CodeOK}
+
+// OK reports whether the check succeeded
+func (s ProbeStatus) OK() bool {
+        return s.Category == CategoryOK
+}
+
+// Summary describes the status in one line, e.g. "Connection refused: dial tcp 192.0.2.1:8448: ..."
+func (s ProbeStatus) Summary() string {
+        description, ok := codeDescriptions[s.Code]
+        if !ok {
+                description = s.Code
+        }
+        if s.Detail == "" {
+                return description
+        }
+        return fmt.Sprintf("%s: %s", description, s.Detail)
+}
+
+// Degraded reports whether the server answered, but the answer was wrong
+func (s ProbeStatus) Degraded() bool {
+        return s.Category == CategoryDegraded
+}
+
+// String formats the status the way the tree shows it: "OK", "Degraded (<summary>)" or "Failed (<summary>)"
+func (s ProbeStatus) String() string {
+        if s.OK() {
+                return "OK"
+        }
+        if s.Degraded() {
+                return fmt.Sprintf("Degraded (%s)", s.Summary())
+        }
+        return fmt.Sprintf("Failed (%s)", s.Summary())
+}
+
+// failedStatus builds the status for a failure at step with the given code
+func failedStatus(category StatusCategory, code string, step ProbeStep, detail string) ProbeStatus {
+        return ProbeStatus{Category: category, Code: code, Step: step, Detail: detail}
+}
+
+// classifyResolveError turns an error from resolveMatrixServer into a ProbeStatus.
+// Failures while following a .well-known delegation are reported as delegation problems.
+func classifyResolveError(err error) ProbeStatus {
+        step := StepDNS
+        var resolveErr *resolveError
+        if errors.As(err, &resolveErr) {
+                step = resolveErr.Step
+        }
+
+        status := classifyError(step, err)
+        if step == StepWellKnown {
+                status.Category = CategoryDelegation
+        }
+        return status
+}
+
+// classifyError turns an error from name resolution, dialing, TLS or HTTP into a ProbeStatus.
+// step is the furthest step the probe reached before the error.
+func classifyError(step ProbeStep, err error) ProbeStatus {
+        detail := err.Error()
+
+        // Name resolution
+        var dnsErr *net.DNSError
+        if errors.As(err, &dnsErr) {
+                switch {
+                case dnsErr.IsNotFound:
+                        return failedStatus(CategoryDNS, CodeDNSNotFound, step, detail)
+                case dnsErr.IsTimeout:
+                        return failedStatus(CategoryDNS, CodeDNSTimeout, step, detail)
+                default:
+                        return failedStatus(CategoryDNS, CodeDNSError, step, detail)
+                }
+        }
+
+        // Certificates
+        var invalidErr x509.CertificateInvalidError
+        if errors.As(err, &invalidErr) {
+                if invalidErr.Reason == x509.Expired {
+                        return failedStatus(CategoryTLS, CodeTLSCertExpired, StepTLS, detail)
+                }
+                return failedStatus(CategoryTLS, CodeTLSInvalidCert, StepTLS, detail)
+        }
+        var hostnameErr x509.HostnameError
+        if errors.As(err, &hostnameErr) {
+                return failedStatus(CategoryTLS, CodeTLSWrongName, StepTLS, detail)
+        }
+        var authorityErr x509.UnknownAuthorityError
+        if errors.As(err, &authorityErr) {
+                if authorityErr.Cert != nil && isSelfSigned(authorityErr.Cert) {
+                        return failedStatus(CategoryTLS, CodeTLSSelfSigned, StepTLS, detail)
+                }
+                return failedStatus(CategoryTLS, CodeTLSUnknownAuthority, StepTLS, detail)
+        }
+        var verificationErr *tls.CertificateVerificationError
+        if errors.As(err, &verificationErr) {
+                return failedStatus(CategoryTLS, CodeTLSInvalidCert, StepTLS, detail)
+        }
+        var recordErr tls.RecordHeaderError
+        if errors.As(err, &recordErr) {
+                return failedStatus(CategoryTLS, CodeTLSNotTLS, StepTLS, detail)
+        }
+
+        // Connection level errors
+        switch {
+        case errors.Is(err, syscall.ECONNREFUSED):
+                return failedStatus(CategoryConnection, CodeConnectionRefused, step, detail)
+        case errors.Is(err, syscall.ECONNRESET):
+                return failedStatus(CategoryConnection, CodeConnectionReset, step, detail)
+        case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+                return failedStatus(CategoryConnection, CodeHostUnreachable, step, detail)
+        }
+        var netErr net.Error
+        if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+                return failedStatus(CategoryConnection, CodeTimeout, step, detail)
+        }
+
+        switch step {
+        case StepTLS:
+                return failedStatus(CategoryTLS, CodeTLSHandshakeFailed, step, detail)
+        case StepHTTP:
+                return failedStatus(CategoryHTTP, CodeHTTPError, step, detail)
+        default:
+                return failedStatus(CategoryConnection, CodeConnectionFailed, step, detail)
+        }
+}
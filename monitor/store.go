@@ -0,0 +1,382 @@
+package monitor
+
+import (
+        "bytes"
+        "encoding/binary"
+        "encoding/json"
+        "fmt"
+        "strings"
+        "time"
+
+        bolt "go.etcd.io/bbolt"
+)
+
+// Persistent check history, stored in a local bbolt database
+// ==============================================================
+
+var (
+        checksBucket = []byte("checks") // One nested bucket per server, keyed by check time
+        latestBucket = []byte("latest") // Most recent check record per server
+        roomsBucket  = []byte("rooms")  // One nested bucket per room with its RoomSamples, keyed by time
+        stateBucket  = []byte("state")  // Last known tree, restored on startup
+        treeKey      = []byte("tree")
+)
+
+// Checks and room samples are kept as long as the longest uptime window needs them
+const historyRetention = uptimeRetention
+
+// CheckRecord is a single probe result as stored in the history database. The latest record of every
+// server has every field; the rows of the history keep only what the uptime figures and a look back
+// need, see historyRow.
+type CheckRecord struct {
+        Time      time.Time `json:"time"`
+        Server    string    `json:"server"`
+        Status    string    `json:"status"`
+        Confirmed string    `json:"confirmed,omitempty"` // Status after flap damping
+        Suspect   bool      `json:"suspect,omitempty"`
+        Attempts  int       `json:"attempts,omitempty"`
+        Reason    string    `json:"reason,omitempty"`
+        Category  string    `json:"category,omitempty"`
+        Code      string    `json:"code,omitempty"`
+        Step      string    `json:"step,omitempty"`
+        LatencyMS int64     `json:"latency_ms"`
+
+        Timings    *ProbeTimings   `json:"timings,omitempty"`
+        TLS        *TLSInfo        `json:"tls,omitempty"`
+        Keys       *ProbeStatus    `json:"keys,omitempty"`
+        Software   *ServerSoftware `json:"software,omitempty"`
+        Advisories []string        `json:"advisories,omitempty"` // IDs of the advisories last reported
+}
+
+// BoltStore keeps every probe result and the last known tree in a bbolt database
+type BoltStore struct {
+        db *bolt.DB
+}
+
+// OpenBoltStore opens (or creates) the database at path and makes sure all buckets exist
+func OpenBoltStore(path string) (*BoltStore, error) {
+        db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+        if err != nil {
+                return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+        }
+
+        err = db.Update(func(tx *bolt.Tx) error {
+                for _, name := range [][]byte{checksBucket, latestBucket, roomsBucket, stateBucket} {
+                        if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+                                return err
+                        }
+                }
+                return nil
+        })
+        if err != nil {
+                db.Close()
+                return nil, fmt.Errorf("failed to initialise database %s: %w", path, err)
+        }
+        return &BoltStore{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *BoltStore) Close() error {
+        return s.db.Close()
+}
+
+// newCheckRecord converts a probe result into its stored form
+func newCheckRecord(result CheckResult) CheckRecord {
+        record := CheckRecord{
+                Time:       result.Time.UTC(),
+                Server:     result.Server.String(),
+                Status:     result.Status,
+                Confirmed:  result.Confirmed,
+                Suspect:    result.Suspect,
+                Attempts:   result.Attempts,
+                Category:   string(result.Check.Category),
+                Code:       result.Check.Code,
+                Step:       string(result.Check.Step),
+                LatencyMS:  result.Latency.Milliseconds(),
+                Timings:    &result.Timings,
+                TLS:        result.TLS,
+                Keys:       result.Keys,
+                Software:   result.Software,
+                Advisories: result.Advisories,
+        }
+        if !result.Check.OK() {
+                record.Reason = result.Check.Summary()
+        }
+        return record
+}
+
+// historyRow keeps the time, server, status, failure category, code and step, and latency of a record.
+// Certificates, keys and software rarely change between checks, and the latest record has them.
+func (r CheckRecord) historyRow() CheckRecord {
+        return CheckRecord{
+                Time:      r.Time,
+                Server:    r.Server,
+                Status:    r.Status,
+                Category:  r.Category,
+                Code:      r.Code,
+                Step:      r.Step,
+                LatencyMS: r.LatencyMS,
+        }
+}
+
+// RecordChecks appends the results of a check cycle to the history and updates the latest result per server.
+// Checks that have left the retention period are deleted in the same transaction, and so are the servers
+// that have none left.
+func (s *BoltStore) RecordChecks(results []CheckResult) error {
+        return s.db.Update(func(tx *bolt.Tx) error {
+                checks := tx.Bucket(checksBucket)
+                latest := tx.Bucket(latestBucket)
+                var newest time.Time
+                for _, result := range results {
+                        if result.Time.After(newest) {
+                                newest = result.Time
+                        }
+                        record := newCheckRecord(result)
+                        data, err := json.Marshal(record)
+                        if err != nil {
+                                return err
+                        }
+                        row, err := json.Marshal(record.historyRow())
+                        if err != nil {
+                                return err
+                        }
+
+                        serverChecks, err := checks.CreateBucketIfNotExists([]byte(record.Server))
+                        if err != nil {
+                                return err
+                        }
+                        if err := serverChecks.Put(timeKey(record.Time), row); err != nil {
+                                return err
+                        }
+                        if err := latest.Put([]byte(record.Server), data); err != nil {
+                                return err
+                        }
+                }
+                if newest.IsZero() {
+                        return nil
+                }
+
+                emptied, err := pruneBefore(checks, newest.Add(-historyRetention))
+                if err != nil {
+                        return err
+                }
+                for _, server := range emptied {
+                        if err := latest.Delete(server); err != nil {
+                                return err
+                        }
+                }
+                return nil
+        })
+}
+
+// LatestChecks returns the most recent stored result for every server
+func (s *BoltStore) LatestChecks() (map[string]CheckRecord, error) {
+        records := make(map[string]CheckRecord)
+        err := s.db.View(func(tx *bolt.Tx) error {
+                return tx.Bucket(latestBucket).ForEach(func(k, v []byte) error {
+                        var record CheckRecord
+                        if err := json.Unmarshal(v, &record); err != nil {
+                                return fmt.Errorf("invalid check record for %s: %w", k, err)
+                        }
+                        records[string(k)] = record
+                        return nil
+                })
+        })
+        return records, err
+}
+
+// ChecksSince calls fn with every stored check from since on, server by server in chronological order.
+// The records are history rows, with the status, failure and latency only.
+func (s *BoltStore) ChecksSince(since time.Time, fn func(CheckRecord) error) error {
+        return s.db.View(func(tx *bolt.Tx) error {
+                return tx.Bucket(checksBucket).ForEachBucket(func(server []byte) error {
+                        return forEachSince(tx.Bucket(checksBucket).Bucket(server), since, func(v []byte) error {
+                                var record CheckRecord
+                                if err := json.Unmarshal(v, &record); err != nil {
+                                        return fmt.Errorf("invalid check record for %s: %w", server, err)
+                                }
+                                return fn(record)
+                        })
+                })
+        })
+}
+
+// RecordRoomSamples appends the room samples of a check cycle to the history, deleting the samples
+// that have left the retention period in the same transaction
+func (s *BoltStore) RecordRoomSamples(samples []RoomSample) error {
+        return s.db.Update(func(tx *bolt.Tx) error {
+                rooms := tx.Bucket(roomsBucket)
+                var newest time.Time
+                for _, sample := range samples {
+                        if sample.Time.After(newest) {
+                                newest = sample.Time
+                        }
+                        data, err := json.Marshal(sample)
+                        if err != nil {
+                                return err
+                        }
+                        roomSamples, err := rooms.CreateBucketIfNotExists([]byte(sample.RoomID))
+                        if err != nil {
+                                return err
+                        }
+                        if err := roomSamples.Put(timeKey(sample.Time), data); err != nil {
+                                return err
+                        }
+                }
+                if newest.IsZero() {
+                        return nil
+                }
+                _, err := pruneBefore(rooms, newest.Add(-historyRetention))
+                return err
+        })
+}
+
+// RoomSamplesSince calls fn with every stored room sample from since on, room by room in chronological order
+func (s *BoltStore) RoomSamplesSince(since time.Time, fn func(RoomSample) error) error {
+        return s.db.View(func(tx *bolt.Tx) error {
+                return tx.Bucket(roomsBucket).ForEachBucket(func(roomID []byte) error {
+                        return forEachSince(tx.Bucket(roomsBucket).Bucket(roomID), since, func(v []byte) error {
+                                var sample RoomSample
+                                if err := json.Unmarshal(v, &sample); err != nil {
+                                        return fmt.Errorf("invalid room sample for %s: %w", roomID, err)
+                                }
+                                return fn(sample)
+                        })
+                })
+        })
+}
+
+// forEachSince calls fn with the values of a bucket keyed by timeKey, from since on
+func forEachSince(bucket *bolt.Bucket, since time.Time, fn func(v []byte) error) error {
+        c := bucket.Cursor()
+        for k, v := c.Seek(timeKey(since)); k != nil; k, v = c.Next() {
+                if err := fn(v); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// pruneBefore deletes the values keyed by timeKey before cutoff from every nested bucket of parent,
+// and the nested buckets left empty, whose names it returns. Old keys come first, so only the
+// deleted ones are visited.
+func pruneBefore(parent *bolt.Bucket, cutoff time.Time) ([][]byte, error) {
+        var names [][]byte
+        if err := parent.ForEachBucket(func(name []byte) error {
+                names = append(names, append([]byte(nil), name...))
+                return nil
+        }); err != nil {
+                return nil, err
+        }
+
+        cutoffKey := timeKey(cutoff)
+        var emptied [][]byte
+        for _, name := range names {
+                c := parent.Bucket(name).Cursor()
+                k, _ := c.First()
+                for k != nil && bytes.Compare(k, cutoffKey) < 0 {
+                        if err := c.Delete(); err != nil {
+                                return nil, err
+                        }
+                        k, _ = c.First()
+                }
+                if k == nil {
+                        if err := parent.DeleteBucket(name); err != nil {
+                                return nil, err
+                        }
+                        emptied = append(emptied, name)
+                }
+        }
+        return emptied, nil
+}
+
+// SaveTree stores the room nodes of the tree, keyed by room ID
+func (s *BoltStore) SaveTree(rooms map[string]*TreeNode) error {
+        data, err := json.Marshal(rooms)
+        if err != nil {
+                return err
+        }
+        return s.db.Update(func(tx *bolt.Tx) error {
+                return tx.Bucket(stateBucket).Put(treeKey, data)
+        })
+}
+
+// LoadTree returns the room nodes saved by SaveTree, or an empty map if nothing was saved yet
+func (s *BoltStore) LoadTree() (map[string]*TreeNode, error) {
+        rooms := make(map[string]*TreeNode)
+        err := s.db.View(func(tx *bolt.Tx) error {
+                data := tx.Bucket(stateBucket).Get(treeKey)
+                if data == nil {
+                        return nil
+                }
+                return json.Unmarshal(data, &rooms)
+        })
+        return rooms, err
+}
+
+// timeKey encodes a timestamp so that keys sort chronologically
+func timeKey(t time.Time) []byte {
+        key := make([]byte, 8)
+        binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+        return key
+}
+
+// restoreState loads the last known tree and server statuses from the history store
+func (m *Monitor) restoreState() error {
+        store := m.opts.Store
+        rooms, err := store.LoadTree()
+        if err != nil {
+                return fmt.Errorf("failed to load saved tree: %w", err)
+        }
+        m.tree.Update(func(current map[string]*TreeNode) {
+                for roomID, roomNode := range rooms {
+                        current[roomID] = roomNode
+                }
+        })
+
+        latest, err := store.LatestChecks()
+        if err != nil {
+                return fmt.Errorf("failed to load latest checks: %w", err)
+        }
+        for server, record := range latest {
+                name, err := ParseServerName(server)
+                if err != nil {
+                        continue
+                }
+                // Records from before flap damping only have the status of the check
+                confirmed := record.Confirmed
+                if confirmed == "" {
+                        confirmed = record.Status
+                }
+                m.statuses.Store(name, confirmed)
+                m.damper.restore(name, confirmed)
+
+                // The certificate of a working server that was within the warning period has been warned about
+                if expiresIn, ok := record.TLS.ExpiresIn(record.Time); ok && isStatusOK(record.Status) && expiresIn <= m.opts.CertExpiryWarning {
+                        m.certWarnings.Store(name, record.TLS.Leaf().NotAfter)
+                }
+                if record.Software != nil {
+                        m.software.Store(name, record.Software)
+                }
+                m.advisoryReports.Store(name, strings.Join(record.Advisories, "\n"))
+        }
+
+        fmt.Fprintf(m.opts.Logger, "Restored %d rooms and %d server statuses from history\n", len(rooms), len(latest))
+        return m.restoreUptime(m.opts.Clock.Now())
+}
+
+// saveState writes the results and room samples of a check cycle and the current tree to the history store
+func (m *Monitor) saveState(results []CheckResult, samples []RoomSample) error {
+        store := m.opts.Store
+        if err := store.RecordChecks(results); err != nil {
+                return fmt.Errorf("failed to record checks: %w", err)
+        }
+        if err := store.RecordRoomSamples(samples); err != nil {
+                return fmt.Errorf("failed to record room samples: %w", err)
+        }
+
+        if err := store.SaveTree(m.tree.Snapshot()); err != nil {
+                return fmt.Errorf("failed to save tree: %w", err)
+        }
+        return nil
+}
@@ -0,0 +1,175 @@
+package monitor
+
+import (
+        "crypto/tls"
+        "encoding/json"
+        "net/http/httptrace"
+        "sync"
+        "time"
+)
+
+// Per-phase latency of server checks
+// ==============================================================
+
+// ProbeTimings records how long each phase of a server check took.
+// Phases that did not happen (e.g. DNS for an IP literal) are zero.
+type ProbeTimings struct {
+        Delegation   time.Duration // resolveMatrixServer, including .well-known and SRV lookups
+        DNS          time.Duration // Lookup of the resolved host while dialing
+        Connect      time.Duration // TCP connect
+        TLSHandshake time.Duration // TLS handshake
+        FirstByte    time.Duration // From sending the probe request to the first response byte
+        Total        time.Duration // The whole check, delegation included
+}
+
+// probeTimingsJSON is the JSON form of ProbeTimings, in fractional milliseconds
+type probeTimingsJSON struct {
+        Delegation   float64 `json:"delegation_ms"`
+        DNS          float64 `json:"dns_ms"`
+        Connect      float64 `json:"connect_ms"`
+        TLSHandshake float64 `json:"tls_ms"`
+        FirstByte    float64 `json:"first_byte_ms"`
+        Total        float64 `json:"total_ms"`
+}
+
+func (t ProbeTimings) MarshalJSON() ([]byte, error) {
+        return json.Marshal(probeTimingsJSON{
+                Delegation:   toMilliseconds(t.Delegation),
+                DNS:          toMilliseconds(t.DNS),
+                Connect:      toMilliseconds(t.Connect),
+                TLSHandshake: toMilliseconds(t.TLSHandshake),
+                FirstByte:    toMilliseconds(t.FirstByte),
+                Total:        toMilliseconds(t.Total),
+        })
+}
+
+func (t *ProbeTimings) UnmarshalJSON(data []byte) error {
+        var raw probeTimingsJSON
+        if err := json.Unmarshal(data, &raw); err != nil {
+                return err
+        }
+        *t = ProbeTimings{
+                Delegation:   fromMilliseconds(raw.Delegation),
+                DNS:          fromMilliseconds(raw.DNS),
+                Connect:      fromMilliseconds(raw.Connect),
+                TLSHandshake: fromMilliseconds(raw.TLSHandshake),
+                FirstByte:    fromMilliseconds(raw.FirstByte),
+                Total:        fromMilliseconds(raw.Total),
+        }
+        return nil
+}
+
+// Phases returns the timings by phase name, as used for the metrics labels
+func (t ProbeTimings) Phases() map[string]time.Duration {
+        return map[string]time.Duration{
+                "delegation": t.Delegation,
+                "dns":        t.DNS,
+                "connect":    t.Connect,
+                "tls":        t.TLSHandshake,
+                "first_byte": t.FirstByte,
+                "total":      t.Total,
+        }
+}
+
+func toMilliseconds(d time.Duration) float64 {
+        return float64(d) / float64(time.Millisecond)
+}
+
+func fromMilliseconds(ms float64) time.Duration {
+        return time.Duration(ms * float64(time.Millisecond))
+}
+
+// probeProgress follows a probe request through the hooks of net/http/httptrace. It tracks the
+// step the request is in, so a failure can be attributed to it, and when each phase started and ended.
+type probeProgress struct {
+        mu   sync.Mutex
+        step ProbeStep
+
+        dnsStart, dnsDone         time.Time
+        connectStart, connectDone time.Time
+        tlsStart, tlsDone         time.Time
+        requestSent, firstByte    time.Time
+}
+
+// newProbeProgress starts tracking a request that has not connected yet
+func newProbeProgress() *probeProgress {
+        return &probeProgress{step: StepConnect}
+}
+
+// trace returns the hooks that record phase times and advance the step
+func (p *probeProgress) trace() *httptrace.ClientTrace {
+        return &httptrace.ClientTrace{
+                DNSStart: func(httptrace.DNSStartInfo) {
+                        p.mark(&p.dnsStart)
+                },
+                DNSDone: func(httptrace.DNSDoneInfo) {
+                        p.mark(&p.dnsDone)
+                },
+                ConnectStart: func(network, addr string) {
+                        p.mark(&p.connectStart)
+                },
+                ConnectDone: func(network, addr string, err error) {
+                        p.mark(&p.connectDone)
+                        if err == nil {
+                                p.setStep(StepTLS)
+                        }
+                },
+                TLSHandshakeStart: func() {
+                        p.mark(&p.tlsStart)
+                },
+                TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+                        p.mark(&p.tlsDone)
+                        if err == nil {
+                                p.setStep(StepHTTP)
+                        }
+                },
+                WroteRequest: func(httptrace.WroteRequestInfo) {
+                        p.mark(&p.requestSent)
+                },
+                GotFirstResponseByte: func() {
+                        p.mark(&p.firstByte)
+                },
+        }
+}
+
+// mark records the current time in t, keeping the first value when a hook fires more than once
+func (p *probeProgress) mark(t *time.Time) {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        if t.IsZero() {
+                *t = time.Now()
+        }
+}
+
+func (p *probeProgress) setStep(step ProbeStep) {
+        p.mu.Lock()
+        p.step = step
+        p.mu.Unlock()
+}
+
+// Step returns the step the probe is currently in
+func (p *probeProgress) Step() ProbeStep {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        return p.step
+}
+
+// Timings returns the duration of every phase that completed
+func (p *probeProgress) Timings() ProbeTimings {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        return ProbeTimings{
+                DNS:          between(p.dnsStart, p.dnsDone),
+                Connect:      between(p.connectStart, p.connectDone),
+                TLSHandshake: between(p.tlsStart, p.tlsDone),
+                FirstByte:    between(p.requestSent, p.firstByte),
+        }
+}
+
+// between returns end - start, or zero when either time is missing
+func between(start, end time.Time) time.Duration {
+        if start.IsZero() || end.IsZero() {
+                return 0
+        }
+        return end.Sub(start)
+}
@@ -0,0 +1,133 @@
+package monitor
+
+import (
+        "sort"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// Tree of rooms and servers, written by the sync and check loops and read through snapshots
+// ==============================================================
+
+// TreeNode represents a node in the tree structure for D3.js
+type TreeNode struct {
+        Name       string          `json:"name"`
+        Avatar     string          `json:"avatar,omitempty"`
+        Status     string          `json:"status,omitempty"`      // Add Status field for server status
+        Suspect    bool            `json:"suspect,omitempty"`     // Status is OK, but the last checks failed without reaching the failure threshold yet
+        UserCount  int             `json:"user_count,omitempty"`  // Number of users from this server in this room
+        Check      *ProbeStatus    `json:"check,omitempty"`       // Typed result of the last check of this server
+        Timings    *ProbeTimings   `json:"timings,omitempty"`     // Time taken by each phase of the last check
+        TLS        *TLSInfo        `json:"tls,omitempty"`         // Certificates seen by the last check, shared and never modified
+        Keys       *ProbeStatus    `json:"keys,omitempty"`        // Result of the signing key check, next to the version check in Check
+        Software   *ServerSoftware `json:"software,omitempty"`    // Last implementation and version reported by the server, shared and never modified
+        Advisories []*Advisory     `json:"advisories,omitempty"`  // Advisories matching Software, most severe first; replaced, never modified
+        Uptime     Uptime          `json:"uptime,omitempty"`      // Rolling uptime of a server, or reachable user-minutes of a room; replaced, never modified
+        DepartedAt *time.Time      `json:"departed_at,omitempty"` // When the bot left this room, or the last user of this server left it
+        Children   []*TreeNode     `json:"children,omitempty"`
+}
+
+// treeStore owns the room and server nodes. Writers change them inside Update, which holds a lock;
+// readers get an immutable copy from Snapshot and never see a half-applied update.
+type treeStore struct {
+        mu    sync.Mutex
+        rooms map[string]*TreeNode // Room nodes by room ID, only touched while holding mu
+
+        snapshot atomic.Pointer[map[string]*TreeNode] // Copy of rooms as of the last publish
+        dirty    atomic.Bool                          // Set when rooms changed after the last publish
+}
+
+func newTreeStore() *treeStore {
+        s := &treeStore{rooms: make(map[string]*TreeNode)}
+        s.publish()
+        return s
+}
+
+// Update runs fn with exclusive access to the room nodes. fn must not keep references to the nodes
+// after it returns. The copy for readers is only made by the next Snapshot, so a check cycle or a
+// batch of sync events that updates many nodes in a row costs a single copy.
+func (s *treeStore) Update(fn func(rooms map[string]*TreeNode)) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        fn(s.rooms)
+        s.dirty.Store(true)
+}
+
+// Snapshot returns the room nodes as of the last update. The result is shared and must not be modified.
+func (s *treeStore) Snapshot() map[string]*TreeNode {
+        if s.dirty.Load() {
+                s.mu.Lock()
+                if s.dirty.Load() {
+                        s.publish()
+                }
+                s.mu.Unlock()
+        }
+        return *s.snapshot.Load()
+}
+
+// Has reports whether the tree has a node for the room
+func (s *treeStore) Has(roomID string) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        _, ok := s.rooms[roomID]
+        return ok
+}
+
+// Root returns the snapshot as a single tree for D3.js, with the rooms sorted by ID
+func (s *treeStore) Root() *TreeNode {
+        rooms := s.Snapshot()
+        roomIDs := make([]string, 0, len(rooms))
+        for roomID := range rooms {
+                roomIDs = append(roomIDs, roomID)
+        }
+        sort.Strings(roomIDs)
+
+        root := &TreeNode{
+                Name:     "Root",
+                Status:   "ok",
+                Children: make([]*TreeNode, 0, len(rooms)),
+        }
+        for _, roomID := range roomIDs {
+                root.Children = append(root.Children, rooms[roomID])
+        }
+        return root
+}
+
+// publish stores a deep copy of the room nodes as the current snapshot. The caller holds mu.
+func (s *treeStore) publish() {
+        rooms := make(map[string]*TreeNode, len(s.rooms))
+        for roomID, roomNode := range s.rooms {
+                rooms[roomID] = roomNode.clone()
+        }
+        s.snapshot.Store(&rooms)
+        s.dirty.Store(false)
+}
+
+// clone returns a deep copy of the node and its children
+func (n *TreeNode) clone() *TreeNode {
+        c := *n
+        if n.Check != nil {
+                check := *n.Check
+                c.Check = &check
+        }
+        if n.Keys != nil {
+                keys := *n.Keys
+                c.Keys = &keys
+        }
+        if n.Timings != nil {
+                timings := *n.Timings
+                c.Timings = &timings
+        }
+        if n.DepartedAt != nil {
+                departedAt := *n.DepartedAt
+                c.DepartedAt = &departedAt
+        }
+        if n.Children != nil {
+                c.Children = make([]*TreeNode, len(n.Children))
+                for i, child := range n.Children {
+                        c.Children[i] = child.clone()
+                }
+        }
+        return &c
+}
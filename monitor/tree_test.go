@@ -0,0 +1,159 @@
+package monitor
+
+import (
+        "reflect"
+        "testing"
+)
+
+// statuses returns the status of every room and server node, by room ID and by "room ID/server"
+func statuses(rooms map[string]*TreeNode) map[string]string {
+        result := make(map[string]string)
+        for roomID, roomNode := range rooms {
+                result[roomID] = roomNode.Status
+                for _, serverNode := range roomNode.Children {
+                        result[roomID+"/"+serverNode.Name] = serverNode.Status
+                }
+        }
+        return result
+}
+
+func TestTreeStoreSnapshot(t *testing.T) {
+        s := newTreeStore()
+
+        // Every step runs on the tree left by the previous one
+        steps := []struct {
+                name   string
+                update func(rooms map[string]*TreeNode)
+                want   map[string]string
+        }{
+                {
+                        name: "add a room",
+                        update: func(rooms map[string]*TreeNode) {
+                                rooms["!b"] = &TreeNode{Name: "B", Status: "ok"}
+                        },
+                        want: map[string]string{"!b": "ok"},
+                },
+                {
+                        name: "add a room with a server",
+                        update: func(rooms map[string]*TreeNode) {
+                                rooms["!a"] = &TreeNode{Name: "A", Children: []*TreeNode{{Name: "example.org", Status: "ok"}}}
+                        },
+                        want: map[string]string{"!a": "", "!a/example.org": "ok", "!b": "ok"},
+                },
+                {
+                        name: "change a server",
+                        update: func(rooms map[string]*TreeNode) {
+                                rooms["!a"].Children[0].Status = "offline"
+                        },
+                        want: map[string]string{"!a": "", "!a/example.org": "offline", "!b": "ok"},
+                },
+                {
+                        name: "remove a room",
+                        update: func(rooms map[string]*TreeNode) {
+                                delete(rooms, "!b")
+                        },
+                        want: map[string]string{"!a": "", "!a/example.org": "offline"},
+                },
+        }
+        for _, step := range steps {
+                before := s.Snapshot()
+                wantBefore := statuses(before)
+
+                s.Update(step.update)
+
+                // A snapshot taken before an update must not see it, down to the server nodes
+                if got := statuses(before); !reflect.DeepEqual(got, wantBefore) {
+                        t.Errorf("%s: earlier snapshot changed to %v, want %v", step.name, got, wantBefore)
+                }
+                if got := statuses(s.Snapshot()); !reflect.DeepEqual(got, step.want) {
+                        t.Errorf("%s: snapshot has %v, want %v", step.name, got, step.want)
+                }
+        }
+}
+
+func TestTreeStoreRoot(t *testing.T) {
+        s := newTreeStore()
+        s.Update(func(rooms map[string]*TreeNode) {
+                for _, roomID := range []string{"!c", "!a", "!b"} {
+                        rooms[roomID] = &TreeNode{Name: roomID}
+                }
+        })
+
+        root := s.Root()
+        var got []string
+        for _, roomNode := range root.Children {
+                got = append(got, roomNode.Name)
+        }
+        if want := []string{"!a", "!b", "!c"}; !reflect.DeepEqual(got, want) {
+                t.Errorf("Root has rooms %v, want %v", got, want)
+        }
+
+        tests := []struct {
+                roomID string
+                want   bool
+        }{
+                {"!a", true},
+                {"!c", true},
+                {"!d", false},
+                {"", false},
+        }
+        for _, tt := range tests {
+                if got := s.Has(tt.roomID); got != tt.want {
+                        t.Errorf("Has(%q) = %v, want %v", tt.roomID, got, tt.want)
+                }
+        }
+}
+
+func TestTreeStoreCopiesOnSnapshot(t *testing.T) {
+        setStatus := func(status string) func(rooms map[string]*TreeNode) {
+                return func(rooms map[string]*TreeNode) {
+                        if rooms["!a"] == nil {
+                                rooms["!a"] = &TreeNode{Name: "A"}
+                        }
+                        rooms["!a"].Status = status
+                }
+        }
+
+        s := newTreeStore()
+        last := s.Snapshot()
+
+        // Every step runs its updates, then takes a snapshot and compares it with the one of the previous step
+        steps := []struct {
+                name       string
+                updates    []func(rooms map[string]*TreeNode)
+                wantCopy   bool // Whether the snapshot is a new copy
+                wantStatus string
+        }{
+                {name: "first update", updates: []func(map[string]*TreeNode){setStatus("ok")}, wantCopy: true, wantStatus: "ok"},
+                {name: "no update", wantCopy: false, wantStatus: "ok"},
+                {name: "several updates", updates: []func(map[string]*TreeNode){setStatus("offline"), setStatus("error")}, wantCopy: true, wantStatus: "error"},
+                {name: "update without changes", updates: []func(map[string]*TreeNode){func(map[string]*TreeNode) {}}, wantCopy: true, wantStatus: "error"},
+                {name: "no update again", wantCopy: false, wantStatus: "error"},
+        }
+        for _, step := range steps {
+                for _, update := range step.updates {
+                        s.Update(update)
+                }
+                if !s.Has("!a") {
+                        t.Errorf("%s: Has does not see the room before the next snapshot", step.name)
+                }
+
+                got := s.Snapshot()
+                if copied := got["!a"] != last["!a"]; copied != step.wantCopy {
+                        t.Errorf("%s: snapshot copied: %v, want %v", step.name, copied, step.wantCopy)
+                }
+                if status := got["!a"].Status; status != step.wantStatus {
+                        t.Errorf("%s: snapshot has status %q, want %q", step.name, status, step.wantStatus)
+                }
+                if again := s.Snapshot(); again["!a"] != got["!a"] {
+                        t.Errorf("%s: a second snapshot made another copy", step.name)
+                }
+                last = got
+        }
+
+        // Updates alone never copy the tree
+        unchanged := func(map[string]*TreeNode) {}
+        if allocs := testing.AllocsPerRun(100, func() { s.Update(unchanged) }); allocs != 0 {
+                t.Errorf("Update allocated %v times, want no copy before the next snapshot", allocs)
+        }
+}
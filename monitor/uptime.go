@@ -0,0 +1,279 @@
+package monitor
+
+import (
+        "fmt"
+        "sync"
+        "time"
+)
+
+// Uptime: rolling availability of every server, and reachable user-minutes of every room
+// ==============================================================
+
+const (
+        uptimeBucket    = time.Hour           // Resolution of the rolling figures
+        uptimeRetention = 30 * 24 * time.Hour // Longest window
+)
+
+// Windows the figures are reported for, by the name used in Uptime
+var uptimeWindows = []struct {
+        Name     string
+        Duration time.Duration
+}{
+        {"24h", 24 * time.Hour},
+        {"7d", 7 * 24 * time.Hour},
+        {"30d", uptimeRetention},
+}
+
+// UptimeFigure is the availability over one window: the share of OK checks for a server,
+// or the share of user-minutes whose server was reachable for a room
+type UptimeFigure struct {
+        Ratio                float64 `json:"ratio"` // From 0 to 1
+        Checks               int     `json:"checks,omitempty"`
+        UserMinutes          float64 `json:"user_minutes,omitempty"`
+        ReachableUserMinutes float64 `json:"reachable_user_minutes,omitempty"`
+}
+
+// Uptime holds the figures by window name: "24h", "7d" and "30d". Windows without data are left out.
+type Uptime map[string]UptimeFigure
+
+// RoomSample is the reachability of the members of a room in one check cycle, as stored in the history
+type RoomSample struct {
+        Time           time.Time `json:"time"`
+        RoomID         string    `json:"room_id"`
+        Users          int       `json:"users"`           // Joined users on all servers of the room
+        ReachableUsers int       `json:"reachable_users"` // Joined users on servers whose check was OK
+        Minutes        float64   `json:"minutes"`         // Time the sample stands for, the check interval
+}
+
+// uptimeCounts sums up the checks and room samples of one bucket
+type uptimeCounts struct {
+        Checks               int
+        OK                   int
+        UserMinutes          float64
+        ReachableUserMinutes float64
+}
+
+// uptimeSeries holds the counts by the start of their bucket, in Unix seconds
+type uptimeSeries map[int64]*uptimeCounts
+
+func (s uptimeSeries) bucket(t time.Time) *uptimeCounts {
+        key := t.Truncate(uptimeBucket).Unix()
+        counts, ok := s[key]
+        if !ok {
+                counts = &uptimeCounts{}
+                s[key] = counts
+        }
+        return counts
+}
+
+// uptime adds up the buckets of every window ending at now
+func (s uptimeSeries) uptime(now time.Time) Uptime {
+        uptime := make(Uptime)
+        for _, window := range uptimeWindows {
+                since := now.Add(-window.Duration).Truncate(uptimeBucket).Unix()
+                var total uptimeCounts
+                for start, counts := range s {
+                        if start >= since {
+                                total.Checks += counts.Checks
+                                total.OK += counts.OK
+                                total.UserMinutes += counts.UserMinutes
+                                total.ReachableUserMinutes += counts.ReachableUserMinutes
+                        }
+                }
+
+                switch {
+                case total.Checks > 0:
+                        uptime[window.Name] = UptimeFigure{
+                                Ratio:  float64(total.OK) / float64(total.Checks),
+                                Checks: total.Checks,
+                        }
+                case total.UserMinutes > 0:
+                        uptime[window.Name] = UptimeFigure{
+                                Ratio:                total.ReachableUserMinutes / total.UserMinutes,
+                                UserMinutes:          total.UserMinutes,
+                                ReachableUserMinutes: total.ReachableUserMinutes,
+                        }
+                }
+        }
+        return uptime
+}
+
+// uptimeTracker keeps hourly counts for the last 30 days, per server and per room
+type uptimeTracker struct {
+        mu      sync.Mutex
+        servers map[ServerName]uptimeSeries
+        rooms   map[string]uptimeSeries
+}
+
+func newUptimeTracker() *uptimeTracker {
+        return &uptimeTracker{
+                servers: make(map[ServerName]uptimeSeries),
+                rooms:   make(map[string]uptimeSeries),
+        }
+}
+
+// addCheck counts one check of a server
+func (t *uptimeTracker) addCheck(server ServerName, at time.Time, ok bool) {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        series, found := t.servers[server]
+        if !found {
+                series = make(uptimeSeries)
+                t.servers[server] = series
+        }
+        counts := series.bucket(at)
+        counts.Checks++
+        if ok {
+                counts.OK++
+        }
+}
+
+// addRoomSample counts the user-minutes of one check cycle of a room
+func (t *uptimeTracker) addRoomSample(sample RoomSample) {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        series, found := t.rooms[sample.RoomID]
+        if !found {
+                series = make(uptimeSeries)
+                t.rooms[sample.RoomID] = series
+        }
+        counts := series.bucket(sample.Time)
+        counts.UserMinutes += float64(sample.Users) * sample.Minutes
+        counts.ReachableUserMinutes += float64(sample.ReachableUsers) * sample.Minutes
+}
+
+// prune drops the buckets that have left the longest window, and servers and rooms without any left
+func (t *uptimeTracker) prune(now time.Time) {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        oldest := now.Add(-uptimeRetention).Truncate(uptimeBucket).Unix()
+        for roomID, series := range t.rooms {
+                if series.prune(oldest) {
+                        delete(t.rooms, roomID)
+                }
+        }
+        for server, series := range t.servers {
+                if series.prune(oldest) {
+                        delete(t.servers, server)
+                }
+        }
+}
+
+// prune drops the buckets older than oldest and reports whether the series is now empty
+func (s uptimeSeries) prune(oldest int64) bool {
+        for start := range s {
+                if start < oldest {
+                        delete(s, start)
+                }
+        }
+        return len(s) == 0
+}
+
+// server returns the figures of a server
+func (t *uptimeTracker) server(server ServerName, now time.Time) Uptime {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        return t.servers[server].uptime(now)
+}
+
+// room returns the figures of a room
+func (t *uptimeTracker) room(roomID string, now time.Time) Uptime {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        return t.rooms[roomID].uptime(now)
+}
+
+// recordUptime counts the checks of a cycle and works out the reachable users of every room.
+// It returns the room samples, to be saved in the history.
+func (m *Monitor) recordUptime(now time.Time, roomServers []roomServer, results map[ServerName]CheckResult) []RoomSample {
+        for server, result := range results {
+                m.uptime.addCheck(server, result.Time, result.Check.OK())
+        }
+
+        samples := make(map[string]*RoomSample)
+        var order []string
+        for _, rs := range roomServers {
+                sample, ok := samples[rs.RoomID]
+                if !ok {
+                        sample = &RoomSample{Time: now, RoomID: rs.RoomID, Minutes: m.opts.Interval.Minutes()}
+                        samples[rs.RoomID] = sample
+                        order = append(order, rs.RoomID)
+                }
+                sample.Users += rs.UserCount
+                if results[rs.Server].Check.OK() {
+                        sample.ReachableUsers += rs.UserCount
+                }
+        }
+
+        roomSamples := make([]RoomSample, 0, len(order))
+        for _, roomID := range order {
+                m.uptime.addRoomSample(*samples[roomID])
+                roomSamples = append(roomSamples, *samples[roomID])
+        }
+        m.uptime.prune(now)
+        return roomSamples
+}
+
+// restoreUptime rebuilds the figures of the last 30 days from the history store
+func (m *Monitor) restoreUptime(now time.Time) error {
+        since := now.Add(-uptimeRetention)
+        checks, samples := 0, 0
+        err := m.opts.Store.ChecksSince(since, func(record CheckRecord) error {
+                server, err := ParseServerName(record.Server)
+                if err != nil {
+                        return nil
+                }
+                m.uptime.addCheck(server, record.Time, isStatusOK(record.Status))
+                checks++
+                return nil
+        })
+        if err != nil {
+                return fmt.Errorf("failed to load checks: %w", err)
+        }
+        err = m.opts.Store.RoomSamplesSince(since, func(sample RoomSample) error {
+                m.uptime.addRoomSample(sample)
+                samples++
+                return nil
+        })
+        if err != nil {
+                return fmt.Errorf("failed to load room samples: %w", err)
+        }
+        fmt.Fprintf(m.opts.Logger, "Restored uptime from %d checks and %d room samples\n", checks, samples)
+        return nil
+}
+
+// RoomUptime is the reachable user-minutes of a room
+type RoomUptime struct {
+        Name   string `json:"name"`
+        Uptime Uptime `json:"uptime"`
+}
+
+// UptimeReport holds the figures of every server and room with data in the last 30 days
+type UptimeReport struct {
+        Servers map[string]Uptime     `json:"servers"`
+        Rooms   map[string]RoomUptime `json:"rooms"` // By room ID
+}
+
+// Uptime returns the rolling uptime of every server and the reachable user-minutes of every room
+func (m *Monitor) Uptime() UptimeReport {
+        now := m.opts.Clock.Now()
+        names := m.tree.Snapshot()
+
+        m.uptime.mu.Lock()
+        defer m.uptime.mu.Unlock()
+        report := UptimeReport{
+                Servers: make(map[string]Uptime, len(m.uptime.servers)),
+                Rooms:   make(map[string]RoomUptime, len(m.uptime.rooms)),
+        }
+        for server, series := range m.uptime.servers {
+                report.Servers[server.String()] = series.uptime(now)
+        }
+        for roomID, series := range m.uptime.rooms {
+                room := RoomUptime{Name: roomID, Uptime: series.uptime(now)}
+                if roomNode, ok := names[roomID]; ok {
+                        room.Name = roomNode.Name
+                }
+                report.Rooms[roomID] = room
+        }
+        return report
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+        "context"
+        "flag"
+        "fmt"
+        "io"
+        "math"
+        "os"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+
+        "maunium.net/go/mautrix/id"
+
+        "github.com/ricardo-duarte-av/matrix-health/monitor"
+)
+
+// Nagios/Icinga plugin: one check cycle, plugin output with perfdata, and the standard exit codes
+// ==============================================================
+
+const (
+        pluginOK       = 0
+        pluginWarning  = 1
+        pluginCritical = 2
+        pluginUnknown  = 3
+)
+
+var pluginStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// pluginResult is what the plugin prints: a state, a summary, perfdata and optional details
+type pluginResult struct {
+        State    int
+        Summary  string
+        Perfdata []string
+        Details  []string // Further lines, shown as long output
+}
+
+// print writes the result in the plugin output format and returns the exit code
+func (r pluginResult) print(out io.Writer) int {
+        fmt.Fprintf(out, "MATRIX-HEALTH %s - %s", pluginStates[r.State], r.Summary)
+        if len(r.Perfdata) > 0 {
+                fmt.Fprintf(out, " | %s", strings.Join(r.Perfdata, " "))
+        }
+        fmt.Fprintln(out)
+        for _, line := range r.Details {
+                fmt.Fprintln(out, line)
+        }
+        return r.State
+}
+
+func pluginUnknownResult(format string, args ...interface{}) pluginResult {
+        return pluginResult{State: pluginUnknown, Summary: fmt.Sprintf(format, args...)}
+}
+
+// perfdata formats one perfdata value: 'label'=value[unit];warning;critical;min;max
+func perfdata(label string, value float64, unit, warning, critical, min, max string) string {
+        return strings.TrimRight(fmt.Sprintf("'%s'=%s%s;%s;%s;%s;%s", label, formatPerfValue(value), unit, warning, critical, min, max), ";")
+}
+
+func formatPerfValue(value float64) string {
+        return strconv.FormatFloat(math.Round(value*1000)/1000, 'f', -1, 64)
+}
+
+// nagiosCommand runs one check cycle over every room, or over the room of -room, or checks the
+// server of -server without logging in, and reports like a Nagios/Icinga plugin
+func nagiosCommand(ctx context.Context, args []string) int {
+        logOutput = os.Stderr
+
+        // Bad arguments are UNKNOWN, not the exit code 2 of the flag package, which would mean CRITICAL
+        flags := flag.NewFlagSet("nagios", flag.ContinueOnError)
+        flags.SetOutput(os.Stderr)
+        addGlobalFlags(flags)
+        room := flags.String("room", "", "check only the servers of this room ID")
+        server := flags.String("server", "", "check only this server name, without logging in")
+        warning := flags.Float64("warning", 10, "percentage of the users of a room on unreachable servers for WARNING")
+        critical := flags.Float64("critical", 25, "percentage of the users of a room on unreachable servers for CRITICAL")
+        timeout := flags.Duration("timeout", 55*time.Second, "time allowed before giving up with UNKNOWN")
+        if err := flags.Parse(args); err != nil {
+                return pluginUnknownResult("invalid arguments: %v", err).print(os.Stdout)
+        }
+        if flags.NArg() != 0 || (*room != "" && *server != "") {
+                return pluginUnknownResult("invalid arguments: use at most one of -room and -server, and no other arguments").print(os.Stdout)
+        }
+        if *warning > *critical {
+                return pluginUnknownResult("invalid thresholds: -warning %g is above -critical %g", *warning, *critical).print(os.Stdout)
+        }
+
+        ctx, cancel := context.WithTimeout(ctx, *timeout)
+        defer cancel()
+
+        var result pluginResult
+        if *server != "" {
+                result = pluginCheckServer(ctx, *server)
+        } else {
+                result = pluginCheckRooms(ctx, id.RoomID(*room), *warning, *critical)
+        }
+        if ctx.Err() != nil && result.State != pluginUnknown {
+                result = pluginUnknownResult("no result within %s", *timeout)
+        }
+        return result.print(os.Stdout)
+}
+
+// pluginCheckServer checks a single server: WARNING if it answers but is misconfigured or its
+// signing keys do not verify, CRITICAL if it cannot be reached
+func pluginCheckServer(ctx context.Context, name string) pluginResult {
+        server, err := monitor.ParseServerName(name)
+        if err != nil {
+                return pluginUnknownResult("invalid server name: %v", err)
+        }
+        if err := loadConfig(cli.ConfigPath, false); err != nil {
+                return pluginUnknownResult("invalid configuration: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
+        }
+        mon, err := monitor.New(config.monitorOptions())
+        if err != nil {
+                return pluginUnknownResult("failed to create monitor: %v", err)
+        }
+
+        check := mon.CheckServer(ctx, server)
+        result := pluginResult{
+                State:    pluginOK,
+                Summary:  fmt.Sprintf("%s: %s", server, check.Status),
+                Perfdata: []string{perfdata("latency", check.Latency.Seconds(), "s", "", "", "0", "")},
+        }
+        switch {
+        case check.Check.Degraded():
+                result.State = pluginWarning
+        case !check.Check.OK():
+                result.State = pluginCritical
+        case check.Keys != nil && !check.Keys.OK():
+                result.State = pluginWarning
+                result.Summary += fmt.Sprintf(", but signing keys: %s", check.Keys)
+        }
+        if check.Software != nil {
+                result.Details = append(result.Details, fmt.Sprintf("Software: %s", check.Software))
+        }
+        return result
+}
+
+// pluginRoom sums up the servers of a room after the cycle
+type pluginRoom struct {
+        Name        string
+        Users       int // Users on servers whose status is known
+        Unreachable int // Users on servers whose check failed
+}
+
+func (r pluginRoom) unreachablePercent() float64 {
+        if r.Users == 0 {
+                return 0
+        }
+        return 100 * float64(r.Unreachable) / float64(r.Users)
+}
+
+// pluginCheckRooms logs in, with a temporary device unless an access token is configured, runs one
+// check cycle and rates the room with the largest share of unreachable users against the thresholds
+func pluginCheckRooms(ctx context.Context, roomID id.RoomID, warning, critical float64) pluginResult {
+        if err := loadConfig(cli.ConfigPath, true); err != nil {
+                return pluginUnknownResult("invalid configuration: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
+        }
+        client, newDevice, err := login(ctx)
+        if err != nil {
+                return pluginUnknownResult("%v", err)
+        }
+        if newDevice {
+                defer logout(client)
+        }
+
+        opts := config.monitorOptions()
+        opts.Client = monitor.NewMatrixClient(client)
+        opts.Silent = true
+        if roomID != "" {
+                opts.Rooms = []id.RoomID{roomID}
+        }
+        mon, err := monitor.New(opts)
+        if err != nil {
+                return pluginUnknownResult("failed to create monitor: %v", err)
+        }
+        if err := mon.RunOnce(ctx); err != nil {
+                return pluginUnknownResult("check cycle did not complete: %v", err)
+        }
+
+        return ratePluginRooms(mon.Rooms(), mon.Results(), roomID, warning, critical)
+}
+
+// ratePluginRooms rates the room of roomNodes with the largest share of unreachable users against the
+// thresholds, and adds the perfdata of the servers and results. Only roomID is rated when it is set;
+// the log room and the rooms that were left never are.
+func ratePluginRooms(roomNodes map[string]*monitor.TreeNode, results map[monitor.ServerName]monitor.CheckResult, roomID id.RoomID, warning, critical float64) pluginResult {
+        // Sum up the users of every room, and find the servers that are down. A server that has not been
+        // checked, e.g. because the cycle ran out of time, is neither: its users are left out of the shares.
+        var rooms []pluginRoom
+        down := make(map[string]string)
+        up := make(map[string]bool)
+        unknown := make(map[string]bool)
+        for nodeID, roomNode := range roomNodes {
+                if (roomID != "" && nodeID != string(roomID)) || nodeID == config.LogRoom || roomNode.DepartedAt != nil {
+                        continue
+                }
+                room := pluginRoom{Name: roomNode.Name}
+                for _, serverNode := range roomNode.Children {
+                        if serverNode.DepartedAt != nil {
+                                continue
+                        }
+                        switch serverNode.Status {
+                        case "", "unknown":
+                                unknown[serverNode.Name] = true
+                                continue
+                        case "OK":
+                                up[serverNode.Name] = true
+                        default:
+                                room.Unreachable += serverNode.UserCount
+                                down[serverNode.Name] = serverNode.Status
+                        }
+                        room.Users += serverNode.UserCount
+                }
+                rooms = append(rooms, room)
+        }
+        if len(rooms) == 0 {
+                if roomID != "" {
+                        return pluginUnknownResult("not a member of room %s", roomID)
+                }
+                return pluginUnknownResult("no rooms to check")
+        }
+        if len(up)+len(down) == 0 && len(unknown) > 0 {
+                return pluginUnknownResult("none of the %d servers could be checked", len(unknown))
+        }
+        sort.Slice(rooms, func(i, j int) bool {
+                return rooms[i].unreachablePercent() > rooms[j].unreachablePercent()
+        })
+        worst := rooms[0]
+        percent := worst.unreachablePercent()
+
+        result := pluginResult{State: pluginOK}
+        switch {
+        case percent >= critical:
+                result.State = pluginCritical
+        case percent >= warning:
+                result.State = pluginWarning
+        }
+        result.Summary = fmt.Sprintf("%.1f%% of the users of %s are unreachable, %d of %d servers down",
+                percent, worst.Name, len(down), len(down)+len(up))
+        if len(unknown) > 0 {
+                result.Summary += fmt.Sprintf(", %d not checked", len(unknown))
+        }
+
+        // A user in several rooms is counted once per room: the tree has user counts, not user IDs
+        memberships := 0
+        for _, room := range rooms {
+                memberships += room.Unreachable
+        }
+        servers := float64(len(down) + len(up))
+        maxLatency, totalLatency := 0.0, 0.0
+        for _, check := range results {
+                latency := check.Latency.Seconds()
+                totalLatency += latency
+                if latency > maxLatency {
+                        maxLatency = latency
+                }
+        }
+        result.Perfdata = []string{
+                perfdata("servers_up", float64(len(up)), "", "", "", "0", formatPerfValue(servers)),
+                perfdata("servers_down", float64(len(down)), "", "", "", "0", formatPerfValue(servers)),
+                perfdata("servers_unknown", float64(len(unknown)), "", "", "", "0", ""),
+                perfdata("unreachable_memberships", float64(memberships), "", "", "", "0", ""),
+                perfdata("worst_room_unreachable", percent, "%", formatPerfValue(warning), formatPerfValue(critical), "0", "100"),
+                perfdata("latency_max", maxLatency, "s", "", "", "0", ""),
+        }
+        if len(results) > 0 {
+                result.Perfdata = append(result.Perfdata, perfdata("latency_avg", totalLatency/float64(len(results)), "s", "", "", "0", ""))
+        }
+
+        names := make([]string, 0, len(down))
+        for name := range down {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+                result.Details = append(result.Details, fmt.Sprintf("%s: %s", name, down[name]))
+        }
+        names = names[:0]
+        for name := range unknown {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+                result.Details = append(result.Details, fmt.Sprintf("%s: not checked", name))
+        }
+        return result
+}
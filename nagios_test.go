@@ -0,0 +1,182 @@
+package main
+
+import (
+        "bytes"
+        "reflect"
+        "testing"
+        "time"
+
+        "maunium.net/go/mautrix/id"
+
+        "github.com/ricardo-duarte-av/matrix-health/monitor"
+)
+
+func TestPluginResultPrint(t *testing.T) {
+        tests := []struct {
+                result pluginResult
+                want   string
+        }{
+                {pluginResult{State: pluginOK, Summary: "fine"}, "MATRIX-HEALTH OK - fine\n"},
+                {pluginResult{State: pluginWarning, Summary: "slow", Perfdata: []string{"'a'=1", "'b'=2s"}}, "MATRIX-HEALTH WARNING - slow | 'a'=1 'b'=2s\n"},
+                {pluginResult{State: pluginCritical, Summary: "down", Details: []string{"a.example: offline", "b.example: error"}}, "MATRIX-HEALTH CRITICAL - down\na.example: offline\nb.example: error\n"},
+                {pluginUnknownResult("no rooms to check"), "MATRIX-HEALTH UNKNOWN - no rooms to check\n"},
+        }
+        for _, tt := range tests {
+                var out bytes.Buffer
+                if code := tt.result.print(&out); code != tt.result.State {
+                        t.Errorf("%s: exit code %d, want %d", tt.result.Summary, code, tt.result.State)
+                }
+                if got := out.String(); got != tt.want {
+                        t.Errorf("%s: printed %q, want %q", tt.result.Summary, got, tt.want)
+                }
+        }
+}
+
+func TestPerfdata(t *testing.T) {
+        tests := []struct {
+                got  string
+                want string
+        }{
+                {perfdata("servers_up", 3, "", "", "", "0", "4"), "'servers_up'=3;;;0;4"},
+                {perfdata("worst_room_unreachable", 12.34567, "%", "10", "25", "0", "100"), "'worst_room_unreachable'=12.346%;10;25;0;100"},
+                {perfdata("latency_max", 0.5, "s", "", "", "0", ""), "'latency_max'=0.5s;;;0"},
+                {perfdata("count", 2, "", "", "", "", ""), "'count'=2"},
+        }
+        for _, tt := range tests {
+                if tt.got != tt.want {
+                        t.Errorf("perfdata is %q, want %q", tt.got, tt.want)
+                }
+        }
+}
+
+func TestRatePluginRooms(t *testing.T) {
+        server := func(name, status string, users int) *monitor.TreeNode {
+                return &monitor.TreeNode{Name: name, Status: status, UserCount: users}
+        }
+        room := func(name string, servers ...*monitor.TreeNode) *monitor.TreeNode {
+                return &monitor.TreeNode{Name: name, Children: servers}
+        }
+        departed := time.Now()
+
+        config.LogRoom = "!log:example.org"
+        t.Cleanup(func() { config.LogRoom = "" })
+
+        tests := []struct {
+                name        string
+                rooms       map[string]*monitor.TreeNode
+                roomID      id.RoomID
+                wantState   int
+                wantSummary string
+        }{
+                {
+                        name:        "all reachable",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "OK", 10), server("b.example", "OK", 5))},
+                        wantState:   pluginOK,
+                        wantSummary: "0.0% of the users of A are unreachable, 0 of 2 servers down",
+                },
+                {
+                        name:        "below the warning threshold",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "OK", 91), server("b.example", "offline", 9))},
+                        wantState:   pluginOK,
+                        wantSummary: "9.0% of the users of A are unreachable, 1 of 2 servers down",
+                },
+                {
+                        name:        "at the warning threshold",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "OK", 90), server("b.example", "offline", 10))},
+                        wantState:   pluginWarning,
+                        wantSummary: "10.0% of the users of A are unreachable, 1 of 2 servers down",
+                },
+                {
+                        name:        "at the critical threshold",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "OK", 3), server("b.example", "error", 1))},
+                        wantState:   pluginCritical,
+                        wantSummary: "25.0% of the users of A are unreachable, 1 of 2 servers down",
+                },
+                {
+                        name: "worst room decides",
+                        rooms: map[string]*monitor.TreeNode{
+                                "!a": room("A", server("a.example", "OK", 50), server("b.example", "offline", 1)),
+                                "!b": room("B", server("a.example", "OK", 1), server("c.example", "offline", 1)),
+                        },
+                        wantState:   pluginCritical,
+                        wantSummary: "50.0% of the users of B are unreachable, 2 of 3 servers down",
+                },
+                {
+                        name: "only the given room",
+                        rooms: map[string]*monitor.TreeNode{
+                                "!a": room("A", server("a.example", "OK", 50), server("b.example", "offline", 1)),
+                                "!b": room("B", server("a.example", "OK", 1), server("c.example", "offline", 1)),
+                        },
+                        roomID:      "!a",
+                        wantState:   pluginOK,
+                        wantSummary: "2.0% of the users of A are unreachable, 1 of 2 servers down",
+                },
+                {
+                        name: "log room and departures left out",
+                        rooms: map[string]*monitor.TreeNode{
+                                "!a":               room("A", server("a.example", "OK", 10), &monitor.TreeNode{Name: "b.example", Status: "offline", UserCount: 10, DepartedAt: &departed}),
+                                "!left":            {Name: "Left", Children: []*monitor.TreeNode{server("c.example", "offline", 1)}, DepartedAt: &departed},
+                                "!log:example.org": room("Log", server("d.example", "offline", 1)),
+                        },
+                        wantState:   pluginOK,
+                        wantSummary: "0.0% of the users of A are unreachable, 0 of 1 servers down",
+                },
+                {
+                        name:        "unchecked servers left out",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "OK", 9), server("b.example", "offline", 1), server("c.example", "", 90))},
+                        wantState:   pluginWarning,
+                        wantSummary: "10.0% of the users of A are unreachable, 1 of 2 servers down, 1 not checked",
+                },
+                {
+                        name:        "no server checked",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "unknown", 1), server("b.example", "", 1))},
+                        wantState:   pluginUnknown,
+                        wantSummary: "none of the 2 servers could be checked",
+                },
+                {
+                        name:        "not a member of the given room",
+                        rooms:       map[string]*monitor.TreeNode{"!a": room("A", server("a.example", "OK", 1))},
+                        roomID:      "!b",
+                        wantState:   pluginUnknown,
+                        wantSummary: "not a member of room !b",
+                },
+                {
+                        name:        "no rooms",
+                        rooms:       map[string]*monitor.TreeNode{"!log:example.org": room("Log", server("a.example", "OK", 1))},
+                        wantState:   pluginUnknown,
+                        wantSummary: "no rooms to check",
+                },
+        }
+        for _, tt := range tests {
+                result := ratePluginRooms(tt.rooms, nil, tt.roomID, 10, 25)
+                if result.State != tt.wantState || result.Summary != tt.wantSummary {
+                        t.Errorf("%s: %s - %s, want %s - %s", tt.name, pluginStates[result.State], result.Summary, pluginStates[tt.wantState], tt.wantSummary)
+                }
+        }
+}
+
+func TestRatePluginRoomsPerfdata(t *testing.T) {
+        rooms := map[string]*monitor.TreeNode{
+                "!a": {Name: "A", Children: []*monitor.TreeNode{{Name: "a.example", Status: "OK", UserCount: 6}, {Name: "b.example", Status: "offline", UserCount: 2}}},
+                "!b": {Name: "B", Children: []*monitor.TreeNode{{Name: "b.example", Status: "offline", UserCount: 2}, {Name: "c.example", Status: "", UserCount: 1}}},
+        }
+        results := map[monitor.ServerName]monitor.CheckResult{
+                {Host: "a.example"}: {Latency: time.Second},
+                {Host: "b.example"}: {Latency: 3 * time.Second},
+        }
+        result := ratePluginRooms(rooms, results, "", 10, 25)
+
+        // The two users of b.example are in both rooms, and count once per room
+        want := []string{
+                "'servers_up'=1;;;0;2",
+                "'servers_down'=1;;;0;2",
+                "'servers_unknown'=1;;;0",
+                "'unreachable_memberships'=4;;;0",
+                "'worst_room_unreachable'=100%;10;25;0;100",
+                "'latency_max'=3s;;;0",
+                "'latency_avg'=2s;;;0",
+        }
+        if !reflect.DeepEqual(result.Perfdata, want) {
+                t.Errorf("perfdata is %q, want %q", result.Perfdata, want)
+        }
+}
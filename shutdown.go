@@ -0,0 +1,42 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "net/http"
+
+        "maunium.net/go/mautrix"
+
+        "github.com/ricardo-duarte-av/matrix-health/monitor"
+)
+
+// Graceful shutdown on SIGINT/SIGTERM
+// ==============================================================
+
+const defaultShutdownTimeout = 15 // seconds
+
+// shutdown stops the monitor before the deadline of ctx: it waits for the check loop to abandon
+// its probes and saves the state, drains the HTTP server and optionally logs out the device
+func shutdown(ctx context.Context, client *mautrix.Client, mon *monitor.Monitor, httpServer *http.Server) {
+        if err := mon.Stop(ctx); err != nil {
+                fmt.Println("Failed to stop monitor cleanly:", err)
+        }
+
+        // Let requests in flight finish, but refuse new ones
+        if httpServer != nil {
+                if err := httpServer.Shutdown(ctx); err != nil {
+                        fmt.Println("Failed to shut down HTTP server cleanly:", err)
+                } else {
+                        fmt.Println("HTTP server stopped.")
+                }
+        }
+
+        // Remove the device created by the login at startup
+        if config.LogoutOnShutdown {
+                if _, err := client.Logout(ctx); err != nil {
+                        fmt.Println("Failed to log out:", err)
+                } else {
+                        fmt.Println("Logged out.")
+                }
+        }
+}